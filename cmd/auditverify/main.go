@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/drhayt/coatlocker/pkg/audit"
+)
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s LOG...\n\nChecks the hash chain of audit logs, given oldest first.\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Rotated files carry the chain on from one to the next.
+	var last *audit.Entry
+	for _, name := range flag.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("Unable to open audit log: %s", err)
+		}
+		last, err = audit.Verify(file, last)
+		file.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+	}
+
+	if last == nil {
+		log.Printf("No entries")
+		return
+	}
+	log.Printf("Chain intact through entry %d, %s", last.Seq, last.Hash)
+}
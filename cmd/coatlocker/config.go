@@ -0,0 +1,503 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+	"github.com/drhayt/coatlocker/pkg/trace"
+	"github.com/drhayt/jwtclient"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is everything coatlocker can be configured with.  It is read from
+// the YAML file given with -config, if any, and flags and COATLOCKER_*
+// environment variables override whatever the file says.  Sizes are
+// written like 500M and durations like 30s.
+type config struct {
+	Listen   listenConfig   `yaml:"listen"`
+	TLS      tlsConfig      `yaml:"tls"`
+	Auth     authConfig     `yaml:"auth"`
+	Storage  storageConfig  `yaml:"storage"`
+	Limits   limitsConfig   `yaml:"limits"`
+	Policies policiesConfig `yaml:"policies"`
+	Webhooks webhooksConfig `yaml:"webhooks"`
+	Audit    auditConfig    `yaml:"audit"`
+	Tracing  tracingConfig  `yaml:"tracing"`
+}
+
+type listenConfig struct {
+	Address        string        `yaml:"address"`
+	Port           string        `yaml:"port"`
+	MetricsAddress string        `yaml:"metrics_address"`
+	DrainDelay     time.Duration `yaml:"drain_delay"`
+	DrainTimeout   time.Duration `yaml:"drain_timeout"`
+}
+
+// tlsConfig is not reloadable, but the certificate and key files are
+// watched and loaded again whenever they are renewed.
+type tlsConfig struct {
+	Cert         string   `yaml:"cert"`
+	Key          string   `yaml:"key"`
+	MinVersion   string   `yaml:"min_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	ClientAuth   string   `yaml:"client_auth"`
+	ClientCA     string   `yaml:"client_ca"`
+}
+
+// authConfig is reloadable, apart from where the JWT certificate is.  The
+// certificate itself is read again.
+type authConfig struct {
+	JWTCert string   `yaml:"jwt_cert"`
+	Admins  []string `yaml:"admins"`
+}
+
+type storageConfig struct {
+	BaseDirectory  string        `yaml:"base_directory"`
+	Dedup          bool          `yaml:"dedup"`
+	GCInterval     time.Duration `yaml:"gc_interval"`
+	ShardLevels    int           `yaml:"shard_levels"`
+	ShardWidth     int           `yaml:"shard_width"`
+	FoldCase       bool          `yaml:"fold_case"`
+	KeyFile        string        `yaml:"key_file"`
+	TrashRetention time.Duration `yaml:"trash_retention"`
+}
+
+// limitsConfig is reloadable, though the watermarks can only be changed,
+// not turned on or off.
+type limitsConfig struct {
+	MaxEntrySize      string `yaml:"max_entry_size"`
+	LowWatermark      string `yaml:"low_watermark"`
+	CriticalWatermark string `yaml:"critical_watermark"`
+}
+
+// policiesConfig is reloadable.
+type policiesConfig struct {
+	Compression compressionConfig `yaml:"compression"`
+}
+
+type compressionConfig struct {
+	Codec        string   `yaml:"codec"`
+	MinSize      string   `yaml:"min_size"`
+	ContentTypes []string `yaml:"content_types"`
+}
+
+// webhooksConfig is reloadable, though webhooks can only be changed, not
+// turned on or off.
+type webhooksConfig struct {
+	URLs   []string `yaml:"urls"`
+	Secret string   `yaml:"secret"`
+}
+
+type auditConfig struct {
+	Log     string `yaml:"log"`
+	MaxSize string `yaml:"max_size"`
+}
+
+type tracingConfig struct {
+	Exporter string `yaml:"exporter"`
+}
+
+// defaultConfig is the configuration before the file, flags and
+// environment have their say.
+func defaultConfig() *config {
+	return &config{
+		Listen:  listenConfig{DrainDelay: 5 * time.Second, DrainTimeout: 30 * time.Second},
+		TLS:     tlsConfig{MinVersion: defaultTLSVersion, ClientAuth: "none"},
+		Storage: storageConfig{GCInterval: fshandler.DefaultGCInterval, ShardWidth: 2},
+	}
+}
+
+// configFlags defines a flag on flags for each setting, writing to c.
+func configFlags(flags *flag.FlagSet, c *config) {
+	flags.StringVar(&c.Storage.BaseDirectory, "basedir", c.Storage.BaseDirectory, "The directory to use as the base of file uploads/downloads")
+	flags.StringVar(&c.Listen.Port, "port", c.Listen.Port, "The port to listen on")
+	flags.StringVar(&c.Listen.Address, "address", c.Listen.Address, "The address to listen on")
+	flags.StringVar(&c.TLS.Cert, "certpath", c.TLS.Cert, "The path to the certificate")
+	flags.StringVar(&c.TLS.Key, "keypath", c.TLS.Key, "The path to the key")
+	flags.StringVar(&c.TLS.MinVersion, "tlsminversion", c.TLS.MinVersion, "The oldest TLS version to accept, 1.0, 1.1, 1.2 or 1.3")
+	flags.Var(listValue{&c.TLS.CipherSuites}, "tlsciphers", "Comma separated cipher suites to offer up to TLS 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	flags.StringVar(&c.TLS.ClientAuth, "clientauth", c.TLS.ClientAuth, "Whether to ask for client certificates: none, request, require, verify_if_given or require_and_verify")
+	flags.StringVar(&c.TLS.ClientCA, "clientca", c.TLS.ClientCA, "The path to the PEM encoded CA certificates to verify client certificates against")
+	flags.StringVar(&c.Auth.JWTCert, "jwtcertpath", c.Auth.JWTCert, "The path to the PEM encoded JWT certificate to validate against")
+	flags.StringVar(&c.Limits.LowWatermark, "lowwatermark", c.Limits.LowWatermark, "Free space below which health reports degraded, e.g. 2G")
+	flags.StringVar(&c.Limits.CriticalWatermark, "criticalwatermark", c.Limits.CriticalWatermark, "Free space below which uploads are refused, e.g. 500M")
+	flags.BoolVar(&c.Storage.Dedup, "dedup", c.Storage.Dedup, "Store identical object bodies once, keyed by content hash")
+	flags.DurationVar(&c.Storage.GCInterval, "gcinterval", c.Storage.GCInterval, "How often to remove unreferenced blobs when deduplicating")
+	flags.StringVar(&c.Policies.Compression.Codec, "compress", c.Policies.Compression.Codec, "Compress objects at rest with this codec, gzip or zstd")
+	flags.StringVar(&c.Policies.Compression.MinSize, "compressminsize", c.Policies.Compression.MinSize, "Only compress objects at least this big, e.g. 4K")
+	flags.Var(listValue{&c.Policies.Compression.ContentTypes}, "compresstypes", "Comma separated Content-Type prefixes to compress, e.g. text/,application/json")
+	flags.StringVar(&c.Storage.KeyFile, "keyfile", c.Storage.KeyFile, "Encrypt objects at rest with the master keys in this file, newest first")
+	flags.IntVar(&c.Storage.ShardLevels, "shardlevels", c.Storage.ShardLevels, "How many levels of directories to spread objects over, 0 for none")
+	flags.IntVar(&c.Storage.ShardWidth, "shardwidth", c.Storage.ShardWidth, "How many characters of the key name each shard directory")
+	flags.BoolVar(&c.Storage.FoldCase, "foldcase", c.Storage.FoldCase, "Treat keys that differ only in case as the same key")
+	flags.DurationVar(&c.Storage.TrashRetention, "trashretention", c.Storage.TrashRetention, "Keep deleted objects in the trash this long, 0 to delete immediately")
+	flags.Var(listValue{&c.Auth.Admins}, "admins", "Comma separated JWT subjects allowed to use admin endpoints")
+	flags.Var(listValue{&c.Webhooks.URLs}, "webhooks", "Comma separated URLs to send object change events to")
+	flags.StringVar(&c.Webhooks.Secret, "webhooksecret", c.Webhooks.Secret, "Shared secret webhook payloads are signed with")
+	flags.StringVar(&c.Limits.MaxEntrySize, "maxentrysize", c.Limits.MaxEntrySize, "Largest file to store when extracting an uploaded archive, e.g. 1G")
+	flags.StringVar(&c.Audit.Log, "auditlog", c.Audit.Log, "Write a hash chained audit log of every request to this file, or syslog")
+	flags.StringVar(&c.Audit.MaxSize, "auditmaxsize", c.Audit.MaxSize, "Rotate the audit log file once it reaches this size, e.g. 100M")
+	flags.StringVar(&c.Tracing.Exporter, "tracing", c.Tracing.Exporter, "Trace requests to stdout, or to the OTLP/HTTP collector at this URL")
+	flags.DurationVar(&c.Listen.DrainDelay, "draindelay", c.Listen.DrainDelay, "How long to keep serving with readiness failing when shutting down, so load balancers can stop sending requests")
+	flags.DurationVar(&c.Listen.DrainTimeout, "draintimeout", c.Listen.DrainTimeout, "How long to let active requests finish when shutting down")
+	flags.StringVar(&c.Listen.MetricsAddress, "metricsaddress", c.Listen.MetricsAddress, "Serve /metrics over plain HTTP on this address instead of behind authentication on the main port")
+}
+
+// listValue is a flag holding a comma separated list.
+type listValue struct {
+	list *[]string
+}
+
+func (v listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v listValue) Set(s string) error {
+	*v.list = splitList(s)
+	return nil
+}
+
+// override is a setting given by flag or environment variable, which wins
+// over the configuration file.
+type override struct {
+	source string
+	name   string
+	value  string
+}
+
+// envName is the environment variable setting the flag name.
+func envName(name string) string {
+	return "COATLOCKER_" + strings.ToUpper(name)
+}
+
+// configOverrides lists the settings given on the command line, then those
+// given in the environment and not on the command line.  Any flag not in
+// configFlags is left out.  A switch's environment variable is read as a
+// boolean, such as true, false, 1 or 0.
+func configOverrides(flags *flag.FlagSet) []override {
+	known := flag.NewFlagSet("", flag.ContinueOnError)
+	configFlags(known, defaultConfig())
+
+	given := map[string]bool{}
+	var overrides []override
+	flags.Visit(func(f *flag.Flag) {
+		if known.Lookup(f.Name) == nil {
+			return
+		}
+		given[f.Name] = true
+		overrides = append(overrides, override{"-" + f.Name, f.Name, f.Value.String()})
+	})
+	known.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || len(value) == 0 || given[f.Name] {
+			return
+		}
+		overrides = append(overrides, override{envName(f.Name), f.Name, value})
+	})
+	return overrides
+}
+
+// readConfig reads the configuration file at path, or starts from the
+// defaults if path is empty, applies overrides and validates the result.
+func readConfig(path string, overrides []override) (*config, error) {
+	c := defaultConfig()
+	if len(path) != 0 {
+		err := c.load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	configFlags(flags, c)
+	var problems configErrors
+	for _, o := range overrides {
+		err := flags.Set(o.name, o.value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %q is not valid: %s", o.source, o.value, err))
+		}
+	}
+
+	err := c.validate()
+	if invalid, ok := err.(configErrors); ok {
+		problems = append(problems, invalid...)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(problems) != 0 {
+		return nil, problems
+	}
+	return c, nil
+}
+
+// yamlLine finds the line number yaml puts at the start of its errors, and
+// yamlField the setting in an error about a key that is unknown or given
+// twice.
+var (
+	yamlLine  = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+	yamlField = regexp.MustCompile(`^field (\S+) (not found|already set) in type main\.(\w+)$`)
+)
+
+// sections names where each part of config sits in the file.
+var sections = map[string]string{
+	"listenConfig":      "listen.",
+	"tlsConfig":         "tls.",
+	"authConfig":        "auth.",
+	"storageConfig":     "storage.",
+	"limitsConfig":      "limits.",
+	"policiesConfig":    "policies.",
+	"compressionConfig": "policies.compression.",
+	"webhooksConfig":    "webhooks.",
+	"auditConfig":       "audit.",
+	"tracingConfig":     "tracing.",
+}
+
+// load reads the YAML file at path over c.  A key the file should not have
+// is an error, so a misspelt setting does not go quietly ignored.
+func (c *config) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(data, c)
+	if err == nil {
+		return nil
+	}
+
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+	var problems configErrors
+	for _, message := range messages {
+		line := ""
+		if match := yamlLine.FindStringSubmatch(message); match != nil {
+			line = ":" + match[1]
+			message = message[len(match[0]):]
+		}
+		message = strings.TrimPrefix(message, "yaml: ")
+		if match := yamlField.FindStringSubmatch(message); match != nil {
+			setting := sections[match[3]] + match[1]
+			if match[2] == "not found" {
+				message = "unknown setting " + setting
+			} else {
+				message = setting + " is given twice"
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s%s: %s", path, line, message))
+	}
+	return problems
+}
+
+// configErrors is everything wrong with a configuration, one problem to a
+// line.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+func (e *configErrors) add(setting, format string, args ...interface{}) {
+	*e = append(*e, setting+": "+fmt.Sprintf(format, args...))
+}
+
+// validate checks the whole configuration, reporting every problem rather
+// than only the first, each against the setting at fault.
+func (c *config) validate() error {
+	var problems configErrors
+
+	if len(c.Listen.Port) == 0 {
+		problems.add("listen.port", "must be set")
+	} else if port, err := strconv.Atoi(c.Listen.Port); err != nil || port < 1 || port > 65535 {
+		problems.add("listen.port", "%q is not a port number", c.Listen.Port)
+	}
+	if len(c.Listen.MetricsAddress) != 0 {
+		_, _, err := net.SplitHostPort(c.Listen.MetricsAddress)
+		if err != nil {
+			problems.add("listen.metrics_address", "%q is not a host:port address", c.Listen.MetricsAddress)
+		}
+	}
+	if c.Listen.DrainDelay < 0 {
+		problems.add("listen.drain_delay", "must not be negative")
+	}
+	if c.Listen.DrainTimeout < 0 {
+		problems.add("listen.drain_timeout", "must not be negative")
+	}
+
+	certOK := checkReadable(&problems, "tls.cert", c.TLS.Cert)
+	keyOK := checkReadable(&problems, "tls.key", c.TLS.Key)
+	if certOK && keyOK {
+		_, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
+		if err != nil {
+			problems.add("tls", "unable to load the certificate and key: %s", err)
+		}
+	}
+	c.validateTLS(&problems)
+
+	if checkReadable(&problems, "auth.jwt_cert", c.Auth.JWTCert) {
+		_, err := jwtclient.KeyFuncFromPEMFile(c.Auth.JWTCert)
+		if err != nil {
+			problems.add("auth.jwt_cert", "%s", err)
+		}
+	}
+
+	if len(c.Storage.BaseDirectory) == 0 {
+		problems.add("storage.base_directory", "must be set")
+	} else if info, err := os.Stat(c.Storage.BaseDirectory); err != nil {
+		problems.add("storage.base_directory", "%s", err)
+	} else if !info.IsDir() {
+		problems.add("storage.base_directory", "%s is not a directory", c.Storage.BaseDirectory)
+	}
+	if c.Storage.GCInterval < 0 {
+		problems.add("storage.gc_interval", "must not be negative")
+	}
+	err := c.layout().Validate()
+	if err != nil {
+		problems.add("storage", "%s", err)
+	}
+	if len(c.Storage.KeyFile) != 0 {
+		_, err = fshandler.NewFileKeyProvider(c.Storage.KeyFile)
+		if err != nil {
+			problems.add("storage.key_file", "%s", err)
+		}
+	}
+	if c.Storage.TrashRetention < 0 {
+		problems.add("storage.trash_retention", "must not be negative")
+	}
+
+	checkSize(&problems, "limits.max_entry_size", c.Limits.MaxEntrySize)
+	low, lowOK := checkSize(&problems, "limits.low_watermark", c.Limits.LowWatermark)
+	critical, criticalOK := checkSize(&problems, "limits.critical_watermark", c.Limits.CriticalWatermark)
+	if lowOK && criticalOK && low != 0 && critical > low {
+		problems.add("limits.critical_watermark", "must not be above limits.low_watermark")
+	}
+
+	compression := c.Policies.Compression
+	if len(compression.Codec) != 0 {
+		err = (&fshandler.CompressionPolicy{Codec: compression.Codec}).Validate()
+		if err != nil {
+			problems.add("policies.compression.codec", "%s", err)
+		}
+	} else if len(compression.MinSize) != 0 || len(compression.ContentTypes) != 0 {
+		problems.add("policies.compression.codec", "must be set to compress")
+	}
+	checkSize(&problems, "policies.compression.min_size", compression.MinSize)
+
+	if len(c.Webhooks.URLs) != 0 {
+		err = fshandler.NewNotifier(c.Storage.BaseDirectory, c.Webhooks.URLs, c.Webhooks.Secret).Validate()
+		if err != nil {
+			problems.add("webhooks", "%s", err)
+		}
+	}
+
+	switch c.Audit.Log {
+	case "":
+		if len(c.Audit.MaxSize) != 0 {
+			problems.add("audit.max_size", "set without an audit log")
+		}
+	case "syslog":
+		if len(c.Audit.MaxSize) != 0 {
+			problems.add("audit.max_size", "syslog is not rotated by size")
+		}
+	default:
+		checkSize(&problems, "audit.max_size", c.Audit.MaxSize)
+	}
+
+	if len(c.Tracing.Exporter) != 0 && c.Tracing.Exporter != "stdout" {
+		_, err = trace.NewOTLPExporter(c.Tracing.Exporter, "coatlocker")
+		if err != nil {
+			problems.add("tracing.exporter", "must be stdout or an http or https URL, not %q", c.Tracing.Exporter)
+		}
+	}
+
+	if len(problems) != 0 {
+		return problems
+	}
+	return nil
+}
+
+// checkReadable checks the file setting names is set and can be read.
+func checkReadable(problems *configErrors, setting, name string) bool {
+	if len(name) == 0 {
+		problems.add(setting, "must be set")
+		return false
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		problems.add(setting, "%s", err)
+		return false
+	}
+	file.Close()
+	return true
+}
+
+// checkSize parses the size setting holds.
+func checkSize(problems *configErrors, setting, size string) (uint64, bool) {
+	n, err := parseBytes(size)
+	if err != nil {
+		problems.add(setting, "%s", err)
+		return 0, false
+	}
+	return n, true
+}
+
+// size parses a size that has already been validated.
+func size(s string) uint64 {
+	n, _ := parseBytes(s)
+	return n
+}
+
+func (c *config) layout() fshandler.Layout {
+	return fshandler.Layout{Levels: c.Storage.ShardLevels, Width: c.Storage.ShardWidth}
+}
+
+// watermarks reports whether free space is watched at all.
+func (c *config) watermarks() bool {
+	return size(c.Limits.LowWatermark) > 0 || size(c.Limits.CriticalWatermark) > 0
+}
+
+// settings are the reloadable server settings.
+func (c *config) settings() fshandler.Settings {
+	settings := fshandler.Settings{
+		Admins:       c.Auth.Admins,
+		MaxEntrySize: int64(size(c.Limits.MaxEntrySize)),
+	}
+	if len(c.Policies.Compression.Codec) != 0 {
+		settings.Compression = &fshandler.CompressionPolicy{
+			Codec:        c.Policies.Compression.Codec,
+			MinSize:      int64(size(c.Policies.Compression.MinSize)),
+			ContentTypes: c.Policies.Compression.ContentTypes,
+		}
+	}
+	return settings
+}
+
+// configCommand runs "coatlocker config", returning the exit status.
+func configCommand(args []string) int {
+	if len(args) != 2 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: coatlocker config validate FILE")
+		return 2
+	}
+
+	// Check the file as the server would read it, environment and all.
+	_, err := readConfig(args[1], configOverrides(flag.NewFlagSet("", flag.ContinueOnError)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", args[1])
+	return 0
+}
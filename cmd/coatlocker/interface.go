@@ -4,8 +4,21 @@ import "net/http"
 
 type ICoatHandler interface {
 	Validate() error
+	Start() error
+	Stop() error
 	HealthEndpoint(w http.ResponseWriter, r *http.Request)
+	LivenessEndpoint(w http.ResponseWriter, r *http.Request)
+	ReadinessEndpoint(w http.ResponseWriter, r *http.Request)
 	GetEndpoint(w http.ResponseWriter, r *http.Request)
 	PutEndpoint(w http.ResponseWriter, r *http.Request)
 	DeleteEndpoint(w http.ResponseWriter, r *http.Request)
+	PostEndpoint(w http.ResponseWriter, r *http.Request)
+	TrashEndpoint(w http.ResponseWriter, r *http.Request)
+	StatsEndpoint(w http.ResponseWriter, r *http.Request)
+	BatchEndpoint(w http.ResponseWriter, r *http.Request)
+	ArchiveEndpoint(w http.ResponseWriter, r *http.Request)
+	LeaseEndpoint(w http.ResponseWriter, r *http.Request)
+	SearchEndpoint(w http.ResponseWriter, r *http.Request)
+	WebhookEndpoint(w http.ResponseWriter, r *http.Request)
+	WatchEndpoint(w http.ResponseWriter, r *http.Request)
 }
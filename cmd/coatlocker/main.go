@@ -9,84 +9,242 @@ import (
 	"os"
 	"time"
 
-	"bytes"
-
 	"github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/drhayt/coatlocker/pkg/audit"
 	"github.com/drhayt/coatlocker/pkg/fshandler"
-	"github.com/drhayt/jwtclient"
+	"github.com/drhayt/coatlocker/pkg/metrics"
+	"github.com/drhayt/coatlocker/pkg/trace"
 	hndl "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
 
-	var (
-		baseDirectory = flag.String("basedir", os.Getenv("COATLOCKER_BASEDIR"), "The directory to use as the base of file uploads/downloads")
-		listenPort    = flag.String("port", os.Getenv("COATLOCKER_PORT"), "The port to listen on")
-		listenAddress = flag.String("address", os.Getenv("COATLOCKER_ADDRESS"), "The address to listen on")
-		certPath      = flag.String("certpath", os.Getenv("COATLOCKER_CERTPATH"), "The path to the certificate")
-		keyPath       = flag.String("keypath", os.Getenv("COATLOCKER_KEYPATH"), "The path to the key")
-		jwtCertPath   = flag.String("jwtcertpath", os.Getenv("COATLOCKER_JWTCERTPATH"), "The path to the PEM encoded JWT certificate to validate against")
-	)
+	configFlags(flag.CommandLine, defaultConfig())
+	configPath := flag.String("config", os.Getenv("COATLOCKER_CONFIG"), "Read settings from this YAML file, which flags and environment variables override")
 	flag.Parse()
 
-	// FIXME:   Do more argument checking stuff.
+	overrides := configOverrides(flag.CommandLine)
+	cfg, err := readConfig(*configPath, overrides)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s", err)
+	}
 
 	var server ICoatHandler
 
+	// Leave the interface nil unless a key file was given.
+	var encryption fshandler.KeyProvider
+	if len(cfg.Storage.KeyFile) != 0 {
+		keys, err := fshandler.NewFileKeyProvider(cfg.Storage.KeyFile)
+		if err != nil {
+			log.Fatalf("Unable to load encryption keys: %s", err)
+		}
+		encryption = keys
+	}
+
+	certificate, err := fshandler.NewCertificateWatcher(cfg.TLS.Cert, cfg.TLS.Key)
+	if err != nil {
+		log.Fatalf("Unable to load TLS certificate: %s", err)
+	}
+	tlsSettings, err := cfg.serverTLS(certificate)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %s", err)
+	}
+
+	var space *fshandler.SpaceMonitor
+	if cfg.watermarks() {
+		space = fshandler.NewSpaceMonitor(cfg.Storage.BaseDirectory, size(cfg.Limits.LowWatermark), size(cfg.Limits.CriticalWatermark))
+	}
+
+	var events *fshandler.Notifier
+	if len(cfg.Webhooks.URLs) != 0 {
+		events = fshandler.NewNotifier(cfg.Storage.BaseDirectory, cfg.Webhooks.URLs, cfg.Webhooks.Secret)
+	}
+
+	var auditLog *audit.Logger
+	var auditOut io.Closer
+	switch cfg.Audit.Log {
+	case "":
+	case "syslog":
+		out, err := audit.OpenSyslog("coatlocker")
+		if err != nil {
+			log.Fatalf("Unable to open syslog for auditing: %s", err)
+		}
+		auditLog = audit.NewLogger(out, nil)
+		auditOut = out
+	default:
+		out, last, err := audit.OpenFile(cfg.Audit.Log, int64(size(cfg.Audit.MaxSize)))
+		if err != nil {
+			log.Fatalf("Unable to open audit log: %s", err)
+		}
+		auditLog = audit.NewLogger(out, last)
+		auditOut = out
+	}
+
+	registry := metrics.NewRegistry()
+	drain := fshandler.NewDrain()
+	settings := fshandler.NewLiveSettings(cfg.settings())
+
+	var tracer *trace.Tracer
+	if len(cfg.Tracing.Exporter) != 0 {
+		tracer, err = newTracer(cfg.Tracing.Exporter)
+		if err != nil {
+			log.Fatalf("Invalid tracing exporter: %s", err)
+		}
+	}
+
 	// Get a copy of the server struct to work with
 	server = fshandler.Server{
-		BaseDirectory: *baseDirectory,
-		CertFile:      *certPath,
-		KeyFile:       *keyPath,
-		JWTCertFile:   *jwtCertPath,
+		BaseDirectory:  cfg.Storage.BaseDirectory,
+		CertFile:       cfg.TLS.Cert,
+		KeyFile:        cfg.TLS.Key,
+		JWTCertFile:    cfg.Auth.JWTCert,
+		Certificate:    certificate,
+		Space:          space,
+		Dedup:          cfg.Storage.Dedup,
+		GCInterval:     cfg.Storage.GCInterval,
+		Encryption:     encryption,
+		Layout:         cfg.layout(),
+		FoldCase:       cfg.Storage.FoldCase,
+		TrashRetention: cfg.Storage.TrashRetention,
+		Settings:       settings,
+		Events:         events,
+		Watchers:       fshandler.NewWatchers(),
+		Metrics:        registry,
+		Drain:          drain,
 	}
 
 	// Validate our server config.
-	err := server.Validate()
+	err = server.Validate()
 	if err != nil {
 		panic(err)
 	}
 
-	pemBytes := bytes.NewBuffer(nil)
-
-	certFile, err := os.Open(*jwtCertPath)
+	// Kick off background maintenance.
+	err = server.Start()
 	if err != nil {
-		log.Fatalf("Unale to open certificate file: %s, error: %s", *jwtCertPath, err)
+		log.Fatalf("Unable to start server: %s", err)
 	}
 
-	_, err = io.Copy(pemBytes, certFile)
+	// The key tokens are checked against is swapped out on reload.
+	keys := &jwtKeys{}
+	err = keys.load(cfg.Auth.JWTCert)
 	if err != nil {
-		log.Fatalf("Unable to extract certificate: %s", err)
+		log.Fatalf("Unable to load JWT certificate %s: %s", cfg.Auth.JWTCert, err)
 	}
 
-	// Get a closure to use with the jwt stuff.
-	keyFunc, err := jwtclient.KeyFuncFromPEMBytes(pemBytes.Bytes())
-	if err != nil {
-		panic("Unable to create key validation function")
+	reload := &reloader{
+		path:        *configPath,
+		overrides:   overrides,
+		running:     cfg,
+		settings:    settings,
+		space:       space,
+		certificate: certificate,
+		events:      events,
+		keys:        keys,
 	}
+	go reload.run()
 
 	// middleware order from innermost to outermost.
 	router := mux.NewRouter()
 	// Setup jwt middleware.
 	options := jwtmiddleware.Options{
 		SigningMethod:       jwt.SigningMethodRS256,
-		ValidationKeyGetter: keyFunc,
+		ValidationKeyGetter: keys.get,
+		ErrorHandler:        authFailed(registry),
 	}
 	jwthandler := jwtmiddleware.New(options)
 
-	chain := alice.New(timeoutHandler, recoveryHandler, loggingHandler, jwthandler.Handler)
+	authenticate := alice.Constructor(jwthandler.Handler)
+	if tracer != nil {
+		authenticate = tracedAuthentication(authenticate)
+	}
+
+	chain := alice.New(timeoutHandler, recoveryHandler, loggingHandler, authenticate)
+	// Streaming responses can run for as long as they need and must not be
+	// buffered by the timeout handler.
+	streamChain := alice.New(recoveryHandler, loggingHandler, authenticate)
+	// Auditing wraps everything, to see the final outcome, and learns the
+	// subject once the token has been checked.
+	if auditLog != nil {
+		chain = alice.New(auditLog.Handler).Extend(chain).Append(audit.Identify)
+		streamChain = alice.New(auditLog.Handler).Extend(streamChain).Append(audit.Identify)
+	}
+	// Metrics go outside even that, to time the whole request.
+	chain = alice.New(instrument(registry)).Extend(chain)
+	streamChain = alice.New(instrument(registry)).Extend(streamChain)
+	// Tracing goes outermost, so the request span covers everything.
+	if tracer != nil {
+		chain = alice.New(traced(tracer)).Extend(chain)
+		streamChain = alice.New(traced(tracer)).Extend(streamChain)
+	}
 
 	// CoatLocker
 	router.HandleFunc("/health", server.HealthEndpoint).Methods("GET")
-	router.PathPrefix("/").Handler(chain.ThenFunc(server.GetEndpoint)).Methods("GET")
+	router.HandleFunc("/livez", server.LivenessEndpoint).Methods("GET")
+	router.HandleFunc("/readyz", server.ReadinessEndpoint).Methods("GET")
+	if len(cfg.Listen.MetricsAddress) == 0 {
+		router.Handle("/metrics", chain.Then(registry)).Methods("GET")
+	} else {
+		metricsRouter := http.NewServeMux()
+		metricsRouter.Handle("/metrics", registry)
+		go func() {
+			log.Fatal(http.ListenAndServe(cfg.Listen.MetricsAddress, metricsRouter))
+		}()
+	}
+	router.Handle("/_stats", chain.ThenFunc(server.StatsEndpoint)).Methods("GET")
+	router.Handle("/_trash", chain.ThenFunc(server.TrashEndpoint)).Methods("GET")
+	router.Handle("/_batch", chain.ThenFunc(server.BatchEndpoint)).Methods("POST")
+	router.Handle("/_archive", streamChain.ThenFunc(server.ArchiveEndpoint)).Methods("GET")
+	router.Handle("/_search", chain.ThenFunc(server.SearchEndpoint)).Methods("GET")
+	router.Handle("/_webhooks/dead", chain.ThenFunc(server.WebhookEndpoint)).Methods("GET")
+	router.Handle("/_watch", streamChain.ThenFunc(server.WatchEndpoint)).Methods("GET")
+	router.PathPrefix(fshandler.LeasePrefix).Handler(chain.ThenFunc(server.LeaseEndpoint)).Methods("GET", "POST")
+	router.PathPrefix("/").Handler(streamChain.ThenFunc(server.GetEndpoint)).Methods("GET", "HEAD").MatcherFunc(streaming)
+	router.PathPrefix("/").Handler(chain.ThenFunc(server.GetEndpoint)).Methods("GET", "HEAD")
 	router.PathPrefix("/").Handler(chain.ThenFunc(server.PutEndpoint)).Methods("PUT")
 	router.PathPrefix("/").Handler(chain.ThenFunc(server.DeleteEndpoint)).Methods("DELETE")
+	router.PathPrefix("/").Handler(chain.ThenFunc(server.PostEndpoint)).Methods("POST")
+
+	httpServer := &http.Server{
+		Addr:      net.JoinHostPort(cfg.Listen.Address, cfg.Listen.Port),
+		Handler:   router,
+		TLSConfig: tlsSettings,
+	}
+	go func() {
+		// The certificate comes from TLSConfig, so it can be renewed.
+		err := httpServer.ListenAndServeTLS("", "")
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	waitForShutdown(httpServer, drain, cfg.Listen.DrainDelay, cfg.Listen.DrainTimeout)
 
-	log.Fatal(http.ListenAndServeTLS(net.JoinHostPort(*listenAddress, *listenPort), *certPath, *keyPath, router))
+	// No more requests are coming, so whatever they left half done can go.
+	err = server.Stop()
+	if err != nil {
+		log.Printf("Unable to clean up: %s", err)
+	}
+	tracer.Close()
+	if auditOut != nil {
+		auditOut.Close()
+	}
+	log.Printf("Shut down")
+}
 
+// streaming matches GETs that follow an appendable object as it grows or
+// wait for an object to appear, either of which can outlast the timeout.
+func streaming(r *http.Request, rm *mux.RouteMatch) bool {
+	query := r.URL.Query()
+	_, follow := query["follow"]
+	_, wait := query["wait"]
+	return follow || wait
 }
 
 func timeoutHandler(h http.Handler) http.Handler {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware"
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+	"github.com/drhayt/coatlocker/pkg/httpcount"
+	"github.com/drhayt/coatlocker/pkg/metrics"
+	"github.com/justinas/alice"
+)
+
+// instrument returns middleware recording the rate, latency, size and
+// status of requests in registry.
+func instrument(registry *metrics.Registry) alice.Constructor {
+	inFlight := registry.Gauge("coatlocker_http_requests_in_flight", "Requests being served.", "method")
+	durations := registry.Histogram("coatlocker_http_request_duration_seconds", "Time taken to serve requests.", metrics.DefaultBuckets, "method", "code")
+	bytesIn := registry.Counter("coatlocker_http_request_bytes_total", "Bytes of request bodies read.", "method")
+	bytesOut := registry.Counter("coatlocker_http_response_bytes_total", "Bytes of response bodies written.", "method")
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			method := methodLabel(r.Method)
+			inFlight.Add(1, method)
+			defer inFlight.Add(-1, method)
+
+			w, r, body, writer := httpcount.Wrap(w, r, nil)
+			h.ServeHTTP(w, r)
+
+			durations.Observe(time.Since(start).Seconds(), method, strconv.Itoa(writer.Status()))
+			bytesIn.Add(float64(body.Count()), method)
+			bytesOut.Add(float64(writer.Written()), method)
+		})
+	}
+}
+
+// authFailed returns a JWT error handler counting why tokens are refused
+// before answering as the middleware would.
+func authFailed(registry *metrics.Registry) func(http.ResponseWriter, *http.Request, string) {
+	failures := registry.Counter(fshandler.AuthFailureMetric, fshandler.AuthFailureHelp, "reason")
+	return func(w http.ResponseWriter, r *http.Request, err string) {
+		failures.Inc(authFailureReason(err))
+		jwtmiddleware.OnError(w, r, err)
+	}
+}
+
+// authFailureReason classifies the JWT middleware's error messages.
+func authFailureReason(err string) string {
+	switch {
+	case strings.Contains(err, "token not found"):
+		return "missing"
+	case strings.Contains(err, "header format"), strings.Contains(err, "segments"), strings.Contains(err, "base64"), strings.Contains(err, "invalid character"):
+		return "malformed"
+	case strings.Contains(err, "signing method"):
+		return "algorithm"
+	case strings.Contains(err, "expired"), strings.Contains(err, "not valid yet"), strings.Contains(err, "used before issued"):
+		return "expired"
+	case strings.Contains(err, "verification error"):
+		return "signature"
+	}
+	return "invalid"
+}
+
+// methodLabel keeps the method label to the methods the server answers.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "PUT", "POST", "DELETE":
+		return method
+	}
+	return "OTHER"
+}
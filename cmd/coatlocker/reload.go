@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+	"github.com/drhayt/jwtclient"
+)
+
+// jwtKeys hands the JWT middleware the key from the current certificate,
+// which a reload can replace.
+type jwtKeys struct {
+	keyFunc atomic.Value
+}
+
+// load reads the certificate at path, replacing the current key.
+func (k *jwtKeys) load(path string) error {
+	keyFunc, err := jwtclient.KeyFuncFromPEMFile(path)
+	if err != nil {
+		return err
+	}
+	k.keyFunc.Store(keyFunc)
+	return nil
+}
+
+// get is a jwt.Keyfunc.
+func (k *jwtKeys) get(token *jwt.Token) (interface{}, error) {
+	return k.keyFunc.Load().(jwt.Keyfunc)(token)
+}
+
+// reloader applies the configuration file to the running server again on
+// SIGHUP.  Only the auth, limits, policies and webhooks sections can change
+// while the server runs; changes anywhere else are logged and wait for a
+// restart.
+type reloader struct {
+	path      string
+	overrides []override
+	running   *config
+
+	settings    *fshandler.LiveSettings
+	space       *fshandler.SpaceMonitor
+	events      *fshandler.Notifier
+	certificate *fshandler.CertificateWatcher
+	keys        *jwtKeys
+}
+
+// run reloads on every SIGHUP, forever.
+func (r *reloader) run() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		r.reload()
+	}
+}
+
+// reload reads the configuration and applies it, or leaves everything as
+// it was if it is not valid.  A renewed TLS certificate is picked up
+// straight away, with or without a configuration file.
+func (r *reloader) reload() {
+	r.certificate.Check()
+
+	if len(r.path) == 0 {
+		log.Printf("Received SIGHUP but there is no configuration file to reload")
+		return
+	}
+	next, err := readConfig(r.path, r.overrides)
+	if err != nil {
+		log.Printf("Not reloading %s, it is not valid:\n%s", r.path, err)
+		return
+	}
+
+	applied := *r.running
+	for _, setting := range restartRequired(r.running, next) {
+		log.Printf("Ignoring the change to %s until restart", setting)
+	}
+	applied.Auth.Admins = next.Auth.Admins
+	applied.Limits.MaxEntrySize = next.Limits.MaxEntrySize
+	if r.space != nil && next.watermarks() {
+		applied.Limits.LowWatermark = next.Limits.LowWatermark
+		applied.Limits.CriticalWatermark = next.Limits.CriticalWatermark
+	}
+	applied.Policies = next.Policies
+	if r.events != nil && len(next.Webhooks.URLs) != 0 {
+		applied.Webhooks = next.Webhooks
+	}
+
+	err = r.keys.load(applied.Auth.JWTCert)
+	if err != nil {
+		log.Printf("Not reloading %s, unable to read the JWT certificate: %s", r.path, err)
+		return
+	}
+	r.settings.Store(applied.settings())
+	r.space.SetWatermarks(size(applied.Limits.LowWatermark), size(applied.Limits.CriticalWatermark))
+	r.events.SetTargets(applied.Webhooks.URLs, applied.Webhooks.Secret)
+	r.running = &applied
+	log.Printf("Reloaded %s", r.path)
+}
+
+// restartRequired lists the settings that differ between running and next
+// but can only change on restart.  Watermarks and webhooks can be changed
+// but not turned on or off.
+func restartRequired(running, next *config) []string {
+	var settings []string
+	sections := []struct {
+		name          string
+		running, next interface{}
+	}{
+		{"listen", running.Listen, next.Listen},
+		{"tls", running.TLS, next.TLS},
+		{"auth.jwt_cert", running.Auth.JWTCert, next.Auth.JWTCert},
+		{"storage", running.Storage, next.Storage},
+		{"audit", running.Audit, next.Audit},
+		{"tracing", running.Tracing, next.Tracing},
+	}
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.running, section.next) {
+			settings = append(settings, section.name)
+		}
+	}
+	if running.watermarks() != next.watermarks() {
+		settings = append(settings, "limits.low_watermark and limits.critical_watermark")
+	}
+	if (len(running.Webhooks.URLs) != 0) != (len(next.Webhooks.URLs) != 0) {
+		settings = append(settings, "webhooks.urls")
+	}
+	return settings
+}
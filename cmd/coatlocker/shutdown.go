@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+)
+
+// waitForShutdown blocks until SIGTERM or SIGINT, then fails readiness and
+// carries on serving for delay, so load balancers see it and stop sending
+// requests.  Then it stops taking connections and gives active requests up
+// to timeout to finish before cutting them off.  A second signal kills the
+// process straight away.
+func waitForShutdown(server *http.Server, drain *fshandler.Drain, delay, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	signal.Stop(signals)
+
+	log.Printf("Received %s, failing readiness for %s before draining", received, delay)
+	drain.Begin()
+	time.Sleep(delay)
+
+	log.Printf("Draining connections for up to %s", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Cutting off requests still active after %s", timeout)
+		server.Close()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+)
+
+// tlsVersions are the TLS versions a minimum can be set to, by the name
+// used in configuration.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// clientAuthTypes are the ways client certificates can be asked for, by
+// the name used in configuration.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// defaultTLSVersion is the minimum TLS version unless one is configured.
+const defaultTLSVersion = "1.2"
+
+// cipherSuite finds a cipher suite by its standard name, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, reporting whether it is one Go
+// considers insecure.
+func cipherSuite(name string) (id uint16, insecure, ok bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, false, true
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true, true
+		}
+	}
+	return 0, false, false
+}
+
+// validateTLS checks the tls section beyond the certificate and key.
+func (c *config) validateTLS(problems *configErrors) {
+	version, ok := tlsVersions[c.TLS.MinVersion]
+	if !ok {
+		problems.add("tls.min_version", "%q is not one of 1.0, 1.1, 1.2 or 1.3", c.TLS.MinVersion)
+	}
+	if ok && version == tls.VersionTLS13 && len(c.TLS.CipherSuites) != 0 {
+		problems.add("tls.cipher_suites", "cannot be chosen for TLS 1.3, only for 1.2 and below")
+	}
+	for i, name := range c.TLS.CipherSuites {
+		_, insecure, known := cipherSuite(name)
+		switch {
+		case !known:
+			problems.add(fmt.Sprintf("tls.cipher_suites[%d]", i), "%q is not a cipher suite", name)
+		case insecure:
+			problems.add(fmt.Sprintf("tls.cipher_suites[%d]", i), "%s is insecure", name)
+		}
+	}
+
+	clientAuth, ok := clientAuthTypes[c.TLS.ClientAuth]
+	if !ok {
+		problems.add("tls.client_auth", "%q is not one of none, request, require, verify_if_given or require_and_verify", c.TLS.ClientAuth)
+	}
+	verifies := clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert
+	switch {
+	case len(c.TLS.ClientCA) != 0:
+		_, err := loadCertPool(c.TLS.ClientCA)
+		if err != nil {
+			problems.add("tls.client_ca", "%s", err)
+		}
+	case ok && verifies:
+		problems.add("tls.client_ca", "must be set to verify client certificates")
+	}
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s holds no PEM encoded certificates", name)
+	}
+	return pool, nil
+}
+
+// serverTLS is the TLS configuration to listen with, serving whatever
+// certificate is current.
+func (c *config) serverTLS(certificate *fshandler.CertificateWatcher) (*tls.Config, error) {
+	settings := &tls.Config{
+		GetCertificate: certificate.GetCertificate,
+		MinVersion:     tlsVersions[c.TLS.MinVersion],
+		ClientAuth:     clientAuthTypes[c.TLS.ClientAuth],
+	}
+	for _, name := range c.TLS.CipherSuites {
+		id, _, _ := cipherSuite(name)
+		settings.CipherSuites = append(settings.CipherSuites, id)
+	}
+	if len(c.TLS.ClientCA) != 0 {
+		pool, err := loadCertPool(c.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		settings.ClientCAs = pool
+	}
+	return settings, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/drhayt/coatlocker/pkg/httpcount"
+	"github.com/drhayt/coatlocker/pkg/identity"
+	"github.com/drhayt/coatlocker/pkg/trace"
+	"github.com/justinas/alice"
+)
+
+// newTracer returns a tracer exporting to stdout or, given a URL, to an
+// OTLP collector over HTTP.
+func newTracer(exporter string) (*trace.Tracer, error) {
+	if exporter == "stdout" {
+		return trace.NewTracer(trace.NewStdoutExporter(os.Stdout)), nil
+	}
+	otlp, err := trace.NewOTLPExporter(exporter, "coatlocker")
+	if err != nil {
+		return nil, err
+	}
+	return trace.NewTracer(otlp), nil
+}
+
+// traced returns middleware tracing each request in a server span, which
+// continues the caller's trace if it sent a traceparent.
+func traced(tracer *trace.Tracer) alice.Constructor {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := tracer.StartRequest(r)
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("url.path", r.URL.Path)
+			span.SetAttribute("client.address", r.RemoteAddr)
+
+			w, r, body, writer := httpcount.Wrap(w, r.WithContext(ctx), nil)
+			h.ServeHTTP(w, r)
+
+			span.SetAttribute("http.response.status_code", writer.Status())
+			span.SetAttribute("http.request.body.size", body.Count())
+			span.SetAttribute("http.response.body.size", writer.Written())
+			if writer.Status() >= http.StatusInternalServerError {
+				span.SetError(http.StatusText(writer.Status()))
+			}
+			span.End()
+		})
+	}
+}
+
+type authSpanKey struct{}
+
+// authSpan is the span of a request's authentication, and whether it got
+// through.
+type authSpan struct {
+	span   *trace.Span
+	passed bool
+}
+
+// tracedAuthentication wraps the JWT middleware in a span that ends when it
+// hands the request on, or refuses it, and tells the request span who the
+// subject is.
+func tracedAuthentication(authenticate alice.Constructor) alice.Constructor {
+	return func(h http.Handler) http.Handler {
+		step := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auth, ok := r.Context().Value(authSpanKey{}).(*authSpan); ok {
+				auth.passed = true
+				auth.span.End()
+			}
+			if subject := identity.Subject(r); len(subject) != 0 {
+				trace.FromContext(r.Context()).SetAttribute("enduser.id", subject)
+			}
+			h.ServeHTTP(w, r)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := trace.Start(r.Context(), "jwt.validate")
+			auth := &authSpan{span: span}
+			step.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authSpanKey{}, auth)))
+			if !auth.passed {
+				span.SetError("token refused")
+			}
+			span.End()
+		})
+	}
+}
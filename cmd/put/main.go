@@ -132,6 +132,8 @@ func PutFileWithAuth(insecure bool, url, file, key, token string) error {
 		return fmt.Errorf("key already exists")
 	case http.StatusInternalServerError:
 		return fmt.Errorf("Server unavailable")
+	case http.StatusInsufficientStorage:
+		return fmt.Errorf("Server is out of space")
 	case http.StatusCreated:
 		return nil
 	default:
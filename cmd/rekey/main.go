@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+)
+
+func main() {
+
+	foldCaseDefault := false
+	if value := os.Getenv("COATLOCKER_FOLDCASE"); len(value) != 0 {
+		var err error
+		foldCaseDefault, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("COATLOCKER_FOLDCASE: %q is not a boolean", value)
+		}
+	}
+
+	var (
+		baseDirectory = flag.String("basedir", os.Getenv("COATLOCKER_BASEDIR"), "COATLOCKER_BASEDIR: The directory holding the objects")
+		shardLevels   = flag.String("shardlevels", os.Getenv("COATLOCKER_SHARDLEVELS"), "COATLOCKER_SHARDLEVELS: The shard levels the server uses")
+		shardWidth    = flag.String("shardwidth", os.Getenv("COATLOCKER_SHARDWIDTH"), "COATLOCKER_SHARDWIDTH: The shard width the server uses")
+		foldCase      = flag.Bool("foldcase", foldCaseDefault, "COATLOCKER_FOLDCASE: Whether the server folds key case")
+		uriFile       = flag.String("urifile", "", "File of request URIs, one per line, for objects stored without metadata")
+	)
+
+	flag.Parse()
+
+	if len(*baseDirectory) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	layout := fshandler.Layout{Width: 2}
+	var err error
+	if len(*shardLevels) != 0 {
+		layout.Levels, err = strconv.Atoi(*shardLevels)
+		if err != nil {
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	if len(*shardWidth) != 0 {
+		layout.Width, err = strconv.Atoi(*shardWidth)
+		if err != nil {
+			flag.Usage()
+			os.Exit(3)
+		}
+	}
+
+	var uris []string
+	if len(*uriFile) != 0 {
+		uris, err = fshandler.ReadURIFile(*uriFile)
+		if err != nil {
+			log.Fatalf("Unable to read URI file: %s", err)
+		}
+	}
+
+	server := fshandler.Server{
+		BaseDirectory: *baseDirectory,
+		Layout:        layout,
+		FoldCase:      *foldCase,
+	}
+
+	report, err := server.Rekey(uris)
+	if err != nil {
+		log.Fatalf("Rekey stopped after moving %d objects: %s", report.Moved, err)
+	}
+	log.Printf("Moved %d, unchanged %d, unknown %d, conflicts %d", report.Moved, report.Unchanged, report.Unknown, report.Conflicts)
+
+	// Tags are indexed by object name, which Rekey just changed.
+	if report.Moved > 0 {
+		err = server.RebuildTagIndex()
+		if err != nil {
+			log.Fatalf("Unable to rebuild the tag index: %s", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+)
+
+func main() {
+
+	var (
+		baseDirectory = flag.String("basedir", os.Getenv("COATLOCKER_BASEDIR"), "COATLOCKER_BASEDIR: The directory holding the objects")
+		shardLevels   = flag.String("shardlevels", os.Getenv("COATLOCKER_SHARDLEVELS"), "COATLOCKER_SHARDLEVELS: How many levels of directories to spread objects over")
+		shardWidth    = flag.String("shardwidth", os.Getenv("COATLOCKER_SHARDWIDTH"), "COATLOCKER_SHARDWIDTH: How many characters of the key name each shard directory")
+	)
+
+	flag.Parse()
+
+	if len(*baseDirectory) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	levels, err := strconv.Atoi(*shardLevels)
+	if err != nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	width := 2
+	if len(*shardWidth) != 0 {
+		width, err = strconv.Atoi(*shardWidth)
+	}
+	if err != nil {
+		flag.Usage()
+		os.Exit(3)
+	}
+
+	server := fshandler.Server{
+		BaseDirectory: *baseDirectory,
+		Layout:        fshandler.Layout{Levels: levels, Width: width},
+	}
+
+	err = server.Layout.Validate()
+	if err != nil {
+		log.Fatalf("Invalid layout: %s", err)
+	}
+
+	// Servers keep serving while objects move, once they have been
+	// restarted with the new layout.  MigrateLayout checks that they were.
+	moved, err := server.MigrateLayout()
+	if err != nil {
+		log.Fatalf("Migration stopped after %d files: %s", moved, err)
+	}
+	log.Printf("Moved %d files into the %d level layout", moved, levels)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/drhayt/coatlocker/pkg/fshandler"
+)
+
+func main() {
+
+	var (
+		baseDirectory = flag.String("basedir", os.Getenv("COATLOCKER_BASEDIR"), "COATLOCKER_BASEDIR: The directory holding the objects")
+		keyFile       = flag.String("keyfile", os.Getenv("COATLOCKER_KEYFILE"), "COATLOCKER_KEYFILE: The master key file, newest key first")
+	)
+
+	flag.Parse()
+
+	if len(*baseDirectory) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(*keyFile) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	keys, err := fshandler.NewFileKeyProvider(*keyFile)
+	if err != nil {
+		log.Fatalf("Unable to load keys: %s", err)
+	}
+
+	server := fshandler.Server{
+		BaseDirectory: *baseDirectory,
+		Encryption:    keys,
+	}
+
+	// Rotation can run beside the servers, which take the same key locks,
+	// but they must already have been restarted with the new key file to
+	// read the objects it re-wraps.
+	rotated, err := server.RotateKeys()
+	if err != nil {
+		log.Fatalf("Rotation stopped after %d objects: %s", rotated, err)
+	}
+	log.Printf("Re-wrapped %d data keys with master key %s", rotated, keys.CurrentKeyID())
+}
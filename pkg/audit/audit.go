@@ -0,0 +1,141 @@
+// Package audit keeps a tamper evident log of every request: one JSON
+// entry per line, each carrying the hash of the one before it, so removing
+// or changing an entry breaks the chain from there on.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded for a request, by status code.
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// Entry records one request.  Hash is the hex SHA-256 of Prev followed by
+// the entry's JSON with Hash left out, and Prev is the Hash of the entry
+// before, empty for the first entry of a chain.
+type Entry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Subject   string    `json:"subject,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Method    string    `json:"method"`
+	Key       string    `json:"key"`
+	Remote    string    `json:"remote,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Digest    string    `json:"digest,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// outcome classifies a response status.
+func outcome(status int) string {
+	switch {
+	case status == 401 || status == 403:
+		return OutcomeDenied
+	case status >= 400:
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
+
+// hash works out what entry's Hash should be.
+func (entry Entry) hash() (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	io.WriteString(hasher, entry.Prev)
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Logger chains entries and writes them, one line each, to its output.
+type Logger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	seq  int64
+	prev string
+}
+
+// NewLogger returns a logger writing to out, continuing the chain from
+// last if it is not nil.
+func NewLogger(out io.Writer, last *Entry) *Logger {
+	l := &Logger{out: out}
+	if last != nil {
+		l.seq = last.Seq
+		l.prev = last.Hash
+	}
+	return l
+}
+
+// Log chains entry onto the ones before it and writes it out.
+func (l *Logger) Log(entry Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Seq = l.seq + 1
+	entry.Prev = l.prev
+	entry.Outcome = outcome(entry.Status)
+	hash, err := entry.hash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = l.out.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	l.seq = entry.Seq
+	l.prev = entry.Hash
+	return nil
+}
+
+// Verify checks the chain of entries in in, which may continue from last,
+// and returns the last good entry.  The error names the first line that
+// does not follow.
+func Verify(in io.Reader, last *Entry) (*Entry, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return last, fmt.Errorf("line %d is not an entry: %s", line, err)
+		}
+
+		hash, err := entry.hash()
+		if err != nil {
+			return last, err
+		}
+		if hash != entry.Hash {
+			return last, fmt.Errorf("line %d has been altered", line)
+		}
+		if last != nil && (entry.Prev != last.Hash || entry.Seq != last.Seq+1) {
+			return last, fmt.Errorf("line %d does not follow entry %d", line, last.Seq)
+		}
+		last = &entry
+	}
+	return last, scanner.Err()
+}
@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rotatedFormat is appended to a log file's name when it is rotated, so
+// rotated files sort in the order they were written.
+const rotatedFormat = "20060102T150405.000000000Z"
+
+// File is an audit log file, renamed aside and started afresh once it
+// reaches MaxSize.  Rotated files are never removed; the chain runs on
+// from one to the next.  Every entry is synced to disk as it is written.
+type File struct {
+	Path    string
+	MaxSize int64
+
+	file *os.File
+	size int64
+}
+
+// OpenFile opens the audit log at name for appending, rotating it past
+// maxSize bytes if that is positive.  It also returns the last entry in
+// the log, if any, for the chain to continue from.  A log that is missing
+// or empty continues from the last entry of the newest rotated file, so a
+// crash just after rotating does not start a new chain.
+//
+// A log cut short by a crash ends in part of an entry.  That is reported
+// and ended with a newline, and the chain continues from the last whole
+// entry, leaving Verify to flag the gap.
+func OpenFile(name string, maxSize int64) (*File, *Entry, error) {
+	last, partial, err := lastEntry(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if last == nil && !partial {
+		last, err = lastRotatedEntry(name)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f := &File{Path: name, MaxSize: maxSize}
+	err = f.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if partial {
+		seq := int64(0)
+		if last != nil {
+			seq = last.Seq
+		}
+		log.Printf("Audit log %s ends in a partial entry, continuing the chain from entry %d", name, seq)
+		if !endsInNewline(name) {
+			_, err = f.Write([]byte("\n"))
+			if err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+		}
+	}
+	return f, last, nil
+}
+
+// endsInNewline reports whether the last byte of the file at name is a
+// newline.
+func endsInNewline(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	last := make([]byte, 1)
+	_, err = file.Seek(-1, io.SeekEnd)
+	if err == nil {
+		_, err = io.ReadFull(file, last)
+	}
+	return err == nil && last[0] == '\n'
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes one entry, rotating the file first if the entry would take
+// it past MaxSize.
+func (f *File) Write(p []byte) (int, error) {
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, f.file.Sync()
+}
+
+func (f *File) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Path, f.Path+"."+time.Now().UTC().Format(rotatedFormat))
+	if err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+// lastRotatedEntry reads the last whole entry of the newest file the log
+// at name was rotated to, or nil if it has never been rotated.
+func lastRotatedEntry(name string) (*Entry, error) {
+	matches, err := filepath.Glob(name + ".*")
+	if err != nil {
+		return nil, err
+	}
+	newest := ""
+	for _, match := range matches {
+		_, err := time.Parse(rotatedFormat, strings.TrimPrefix(match, name+"."))
+		if err == nil && match > newest {
+			newest = match
+		}
+	}
+	if len(newest) == 0 {
+		return nil, nil
+	}
+	last, _, err := lastEntry(newest)
+	return last, err
+}
+
+// lastEntry reads the last whole entry of the log at name, or nil if there
+// is no log yet, and whether the log ends in part of one.
+func lastEntry(name string) (*Entry, bool, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	var last *Entry
+	partial := false
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		partial = json.Unmarshal(scanner.Bytes(), &entry) != nil
+		if !partial {
+			last = &entry
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, false, scanner.Err()
+	}
+	return last, partial, nil
+}
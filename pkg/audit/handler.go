@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drhayt/coatlocker/pkg/httpcount"
+	"github.com/drhayt/coatlocker/pkg/identity"
+)
+
+type recordKey struct{}
+
+// record is where Identify leaves the subject, and SetKey the key, for
+// Handler.  It is locked since a request that times out is logged while
+// its handler may still be running.
+type record struct {
+	mu      sync.Mutex
+	subject string
+	key     string
+}
+
+// Handler logs every request passing through next.  It belongs outermost,
+// to see the final status of requests that time out, panic or fail
+// authentication, with Identify after authentication to tell it who made
+// them.
+func (l *Logger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &record{}
+		w, r, body, writer := httpcount.Wrap(w, r, sha256.New())
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), recordKey{}, rec)))
+
+		rec.mu.Lock()
+		subject, key := rec.subject, rec.key
+		rec.mu.Unlock()
+		if len(key) == 0 {
+			key = r.RequestURI
+			if i := strings.IndexByte(key, '?'); i >= 0 {
+				key = key[:i]
+			}
+		}
+		bytesIn, digest := body.Sum()
+
+		// The object's digest comes back as the ETag, possibly with the
+		// encoding it was sent in appended.  Without one, uploads are
+		// identified by the digest of what was sent.
+		if etag := strings.Trim(writer.Header().Get("ETag"), `"`); len(etag) != 0 {
+			digest = strings.SplitN(etag, "-", 2)[0]
+		} else if bytesIn == 0 {
+			digest = ""
+		}
+
+		err := l.Log(Entry{
+			Time:      start.UTC(),
+			Subject:   subject,
+			Namespace: namespace(key),
+			Method:    r.Method,
+			Key:       key,
+			Remote:    r.RemoteAddr,
+			Status:    writer.Status(),
+			BytesIn:   bytesIn,
+			BytesOut:  writer.Written(),
+			Digest:    digest,
+			LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+		})
+		if err != nil {
+			log.Printf("Unable to write audit entry for %s %s: %s", r.Method, key, err)
+		}
+	})
+}
+
+// Identify records the authenticated subject of each request for Handler.
+func Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rec, ok := r.Context().Value(recordKey{}).(*record); ok {
+			rec.mu.Lock()
+			rec.subject = identity.Subject(r)
+			rec.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetKey records the canonical key r names for Handler, which otherwise
+// logs the path the request was sent with.
+func SetKey(r *http.Request, key string) {
+	if rec, ok := r.Context().Value(recordKey{}).(*record); ok {
+		rec.mu.Lock()
+		rec.key = key
+		rec.mu.Unlock()
+	}
+}
+
+// namespace is the first element of a key with more than one, as in team
+// for /team/build/42, and empty otherwise.
+func namespace(key string) string {
+	elements := strings.SplitN(strings.TrimPrefix(path.Clean("/"+key), "/"), "/", 2)
+	if len(elements) < 2 {
+		return ""
+	}
+	return elements[0]
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package audit
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// OpenSyslog is not supported on this platform.
+func OpenSyslog(tag string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,266 @@
+package fshandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// AppendOffsetHeader carries an appendable object's current size when an
+// append is refused for giving the wrong offset.
+const AppendOffsetHeader = "X-Coatlocker-Append-Offset"
+
+// tailPollInterval is how often a followed object is checked for growth.
+const tailPollInterval = 250 * time.Millisecond
+
+// appendObject handles POST ?append&offset=n, adding the body to the end of
+// the appendable object for key.  offset must be the object's current size,
+// so a retried or out of order chunk is refused rather than written twice.
+// Appending at offset 0 to a missing key creates the object; adding ?seal
+// seals it after the append.
+//
+// Appendable objects are stored as plain bytes, never compressed,
+// deduplicated or encrypted, since each of those needs the whole object.
+func (s Server) appendObject(w http.ResponseWriter, r *http.Request, canonical, key string, seal bool) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	if s.Encryption != nil || len(r.Header.Get(CustomerKeyHeader)) != 0 {
+		respond.WithStatus(w, r, http.StatusNotImplemented)
+		return
+	}
+
+	if !s.Space.Admit(r.ContentLength) {
+		respond.WithStatus(w, r, http.StatusInsufficientStorage)
+		return
+	}
+
+	// Stage the chunk first so a slow client does not hold the lock.
+	defer r.Body.Close()
+	tmp, _, size, err := s.stage(r.Context(), r.Body)
+	if err != nil {
+		s.respondWriteError(w, r, err)
+		return
+	}
+	defer os.Remove(tmp)
+
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	filepath := s.findPath(key)
+	if checkFile(filepath) != nil {
+		if offset != 0 {
+			w.Header().Set(AppendOffsetHeader, "0")
+			respond.WithStatus(w, r, http.StatusConflict)
+			return
+		}
+		status := s.createAppendable(r.Context(), tmp, key, &objectMeta{
+			Key:         canonical,
+			Size:        size,
+			ContentType: r.Header.Get("Content-Type"),
+			StoredSize:  size,
+			Created:     time.Now().UTC(),
+			Appendable:  true,
+		}, seal)
+		respond.WithStatus(w, r, status)
+		return
+	}
+
+	meta, err := s.statMeta(r.Context(), filepath)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+	if !meta.Appendable || meta.Sealed {
+		respond.WithStatus(w, r, http.StatusConflict)
+		return
+	}
+	if s.locked(meta, r) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+	if offset != meta.Size {
+		w.Header().Set(AppendOffsetHeader, strconv.FormatInt(meta.Size, 10))
+		respond.WithStatus(w, r, http.StatusConflict)
+		return
+	}
+
+	err = s.appendFile(r.Context(), filepath, tmp, meta.StoredSize)
+	if err != nil {
+		s.respondWriteError(w, r, err)
+		return
+	}
+
+	// The new size only counts once the metadata says so.  Until then
+	// readers stop at the old end, and the next append overwrites anything
+	// left past it.
+	meta.Size += size
+	meta.StoredSize += size
+	if seal {
+		err = sealMeta(filepath, meta)
+		if err != nil {
+			respond.WithStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+	err = s.writeMeta(r.Context(), filepath, meta)
+	if err != nil {
+		s.respondWriteError(w, r, err)
+		return
+	}
+	w.Header().Set(AppendOffsetHeader, strconv.FormatInt(meta.Size, 10))
+	respond.WithStatus(w, r, http.StatusOK)
+}
+
+// createAppendable stores the staged first chunk as a new appendable
+// object.  The caller holds the key's lock.
+func (s Server) createAppendable(ctx context.Context, tmp, key string, meta *objectMeta, seal bool) int {
+	if seal {
+		err := sealMeta(tmp, meta)
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+	}
+
+	filepath := s.genPath(key)
+	err := s.placeObject(ctx, filepath, meta, func() error {
+		return os.Link(tmp, filepath)
+	})
+	if err != nil {
+		return s.writeErrorStatus(err)
+	}
+	s.publish(EventCreated, key, meta)
+	return http.StatusCreated
+}
+
+// appendFile writes the contents of src to filepath starting at offset,
+// cutting off anything a failed append left beyond it.
+func (s Server) appendFile(ctx context.Context, filepath, src string, offset int64) error {
+	defer s.timed(ctx, "append")()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(filepath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	err = out.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = out.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// sealObject handles POST ?seal, which ends appends to an object.
+func (s Server) sealObject(w http.ResponseWriter, r *http.Request, key string) {
+	s.updateMeta(w, r, key, func(meta *objectMeta) int {
+		if !meta.Appendable || meta.Sealed {
+			return http.StatusConflict
+		}
+		err := sealMeta(s.findPath(key), meta)
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+}
+
+// sealMeta marks meta sealed and records the digest of the first
+// meta.Size bytes of filepath, which appendable objects go without until
+// they stop changing.
+func sealMeta(filepath string, meta *objectMeta) error {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.CopyN(hasher, file, meta.Size)
+	if err != nil {
+		return err
+	}
+	meta.Digest = hex.EncodeToString(hasher.Sum(nil))
+	meta.Sealed = true
+	return nil
+}
+
+// follow handles GET ?follow[=offset] on an appendable object, streaming
+// it from offset and then whatever is appended to it until it is sealed,
+// deleted, the client goes away or the server shuts down.  The stored file
+// is sent as it is, which is only right for appendable objects.
+func (s Server) follow(w http.ResponseWriter, r *http.Request, key string, meta *objectMeta) {
+	if !meta.Appendable || len(meta.Encoding) != 0 || meta.Encryption != nil {
+		respond.WithStatus(w, r, http.StatusConflict)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("follow"), 10, 64)
+	if len(r.URL.Query().Get("follow")) == 0 {
+		offset, err = 0, nil
+	}
+	if err != nil || offset < 0 || offset > meta.Size {
+		respond.WithStatus(w, r, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	file, err := os.Open(s.findPath(key))
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for {
+		if meta.Size > offset {
+			n, err := io.Copy(w, io.NewSectionReader(file, offset, meta.Size-offset))
+			offset += n
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if !meta.Appendable || meta.Sealed {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.Drain.Done():
+			return
+		case <-time.After(tailPollInterval):
+		}
+
+		meta, err = s.readMeta(r.Context(), s.findPath(key))
+		if err != nil || meta == nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package fshandler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// Archive formats for ArchiveEndpoint.
+const (
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ManifestName is the name of the manifest added to the end of every
+// archive.
+const ManifestName = "_manifest.json"
+
+var archiveContentTypes = map[string]string{
+	ArchiveTar:   "application/x-tar",
+	ArchiveTarGz: "application/gzip",
+	ArchiveZip:   "application/zip",
+}
+
+// ManifestEntry describes one requested object in an archive.  Objects that
+// could not be added are listed with the status a GET of them would have
+// got and no name.
+type ManifestEntry struct {
+	Name        string `json:"name,omitempty"`
+	Key         string `json:"key"`
+	Status      int    `json:"status"`
+	Size        int64  `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// ArchiveEndpoint streams every object under ?prefix=, or each ?key=, as a
+// single archive in the ?format= asked for, tar by default.  Objects are
+// read straight into the response, so nothing is staged.  Each is named
+// after its key without the leading slash, and a manifest with the sha256
+// of every object's bytes comes last.
+func (s Server) ArchiveEndpoint(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = ArchiveTar
+	}
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	keys := query["key"]
+	prefix := query.Get("prefix")
+	if (len(keys) == 0) == (len(prefix) == 0) {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	customer, err := customerKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	if len(prefix) != 0 {
+		keys, _, err = s.prefixKeys(r.Context(), prefix, "", 0)
+		if err != nil {
+			respond.WithStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="archive.`+format+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// Once the archive has started the status can not change, so a failure
+	// leaves it unterminated for the client to notice.
+	archive := newArchiveWriter(format, w)
+	manifest := make([]ManifestEntry, 0, len(keys))
+	for _, uri := range keys {
+		entry, err := s.archiveObject(r.Context(), archive, uri, customer)
+		if err != nil {
+			log.Printf("Archive of %s failed at %s: %s", r.URL, uri, err)
+			return
+		}
+		manifest = append(manifest, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Printf("Archive of %s failed: %s", r.URL, err)
+		return
+	}
+	writer, err := archive.Add(ManifestName, int64(len(data)), time.Now())
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		log.Printf("Archive of %s failed: %s", r.URL, err)
+	}
+}
+
+// archiveObject adds the object at uri to archive.  An error means the
+// archive is broken; an object that simply can not be read is reported in
+// its manifest entry instead.
+func (s Server) archiveObject(ctx context.Context, archive archiveWriter, uri string, customer []byte) (ManifestEntry, error) {
+	entry := ManifestEntry{Key: uri}
+	canonical, key, err := s.uriKey(uri)
+	if err != nil {
+		entry.Status = http.StatusBadRequest
+		return entry, nil
+	}
+
+	filepath := s.findPath(key)
+	if checkFile(filepath) != nil {
+		entry.Status = http.StatusNotFound
+		return entry, nil
+	}
+	meta, err := s.statMeta(ctx, filepath)
+	if err != nil {
+		entry.Status = http.StatusInternalServerError
+		return entry, nil
+	}
+	if !checkCustomerKey(meta.Encryption, customer) {
+		entry.Status = http.StatusForbidden
+		return entry, nil
+	}
+
+	content, err := s.openDecoded(ctx, filepath, meta, customer)
+	if err != nil {
+		entry.Status = http.StatusInternalServerError
+		return entry, nil
+	}
+	defer content.Close()
+
+	entry.Name = strings.TrimPrefix(canonical, "/")
+	writer, err := archive.Add(entry.Name, meta.Size, meta.Created)
+	if err != nil {
+		return entry, err
+	}
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(writer, hasher), content)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Status = http.StatusOK
+	entry.Size = n
+	entry.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	entry.ContentType = meta.ContentType
+	return entry, nil
+}
+
+// archiveWriter hides the differences between the archive formats.
+type archiveWriter interface {
+	// Add starts a new file, which must be written in full before the
+	// next is added.
+	Add(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	switch format {
+	case ArchiveZip:
+		return zipArchive{zip.NewWriter(w)}
+	case ArchiveTarGz:
+		compressor := gzip.NewWriter(w)
+		return tarArchive{tar.NewWriter(compressor), compressor}
+	default:
+		return tarArchive{tar.NewWriter(w), nil}
+	}
+}
+
+type tarArchive struct {
+	writer     *tar.Writer
+	compressor io.Closer
+}
+
+func (a tarArchive) Add(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := a.writer.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modified,
+	})
+	return a.writer, err
+}
+
+func (a tarArchive) Close() error {
+	err := a.writer.Close()
+	if err != nil || a.compressor == nil {
+		return err
+	}
+	return a.compressor.Close()
+}
+
+type zipArchive struct {
+	writer *zip.Writer
+}
+
+func (a zipArchive) Add(name string, size int64, modified time.Time) (io.Writer, error) {
+	return a.writer.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+}
+
+func (a zipArchive) Close() error {
+	return a.writer.Close()
+}
@@ -0,0 +1,183 @@
+package fshandler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// Batch operations.
+const (
+	BatchDelete = "delete"
+	BatchStat   = "stat"
+)
+
+// MaxBatchKeys is the most keys one batch request works on.  A prefix
+// matching more is cut short and reported as truncated; the client carries
+// on from the last key it got back with After.
+const MaxBatchKeys = 1000
+
+// batchWorkers bounds how many keys of a batch are worked on at once.
+const batchWorkers = 8
+
+// maxBatchBody bounds the size of a batch request body.
+const maxBatchBody = 1 << 20
+
+// BatchRequest names the keys a batch works on, either listed or as every
+// key starting with Prefix that sorts after After.
+type BatchRequest struct {
+	Op     string   `json:"op"`
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	After  string   `json:"after,omitempty"`
+}
+
+// BatchResult is the outcome for one key.  Status is the code a single
+// request for the key would have got; the rest is only filled in by a
+// successful stat.
+type BatchResult struct {
+	Key         string     `json:"key"`
+	Status      int        `json:"status"`
+	Size        int64      `json:"size,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	ETag        string     `json:"etag,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+}
+
+// BatchResponse holds a result per key, in the order the keys were given
+// or sorted when they came from a prefix.
+type BatchResponse struct {
+	Results   []BatchResult `json:"results"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// BatchEndpoint deletes or stats many keys in one request.  Each key gets
+// the same checks as it would on its own, so one locked or missing object
+// does not fail the rest.
+func (s Server) BatchEndpoint(w http.ResponseWriter, r *http.Request) {
+	var batch BatchRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&batch)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	if batch.Op != BatchDelete && batch.Op != BatchStat {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	if (len(batch.Keys) == 0) == (len(batch.Prefix) == 0) || len(batch.Keys) > MaxBatchKeys {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	customer, err := customerKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	var response BatchResponse
+	keys := batch.Keys
+	if len(batch.Prefix) != 0 {
+		keys, response.Truncated, err = s.prefixKeys(r.Context(), batch.Prefix, batch.After, MaxBatchKeys)
+		if err != nil {
+			respond.WithStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response.Results = make([]BatchResult, len(keys))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < batchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				response.Results[n] = s.batchKey(r, batch.Op, keys[n], customer)
+			}
+		}()
+	}
+	for n := range keys {
+		work <- n
+	}
+	close(work)
+	wg.Wait()
+
+	respond.With(w, r, http.StatusOK, response)
+}
+
+// batchKey carries out op on the object at uri.
+func (s Server) batchKey(r *http.Request, op, uri string, customer []byte) BatchResult {
+	result := BatchResult{Key: uri}
+	_, key, err := s.uriKey(uri)
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		return result
+	}
+
+	if op == BatchDelete {
+		result.Status = s.deleteKey(r, key)
+		return result
+	}
+
+	filepath := s.findPath(key)
+	if checkFile(filepath) != nil {
+		result.Status = http.StatusNotFound
+		return result
+	}
+	meta, err := s.statMeta(r.Context(), filepath)
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		return result
+	}
+	if !checkCustomerKey(meta.Encryption, customer) {
+		result.Status = http.StatusForbidden
+		return result
+	}
+
+	result.Status = http.StatusOK
+	result.Size = meta.Size
+	result.ContentType = meta.ContentType
+	result.ETag = meta.etag("")
+	result.Created = &meta.Created
+	return result
+}
+
+// prefixKeys lists, in order, the keys of stored objects starting with
+// prefix and sorting after after, up to limit of them if limit is positive.
+// Only objects with metadata record their key, so older objects are never
+// matched.
+func (s Server) prefixKeys(ctx context.Context, prefix, after string, limit int) ([]string, bool, error) {
+	if s.FoldCase {
+		prefix = strings.ToLower(prefix)
+	}
+
+	var keys []string
+	err := s.walkObjects(func(filepath string, info os.FileInfo) error {
+		meta, err := s.readMeta(ctx, filepath)
+		if err != nil || meta == nil {
+			return nil
+		}
+		if strings.HasPrefix(meta.Key, prefix) && meta.Key > after {
+			keys = append(keys, meta.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
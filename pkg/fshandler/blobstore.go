@@ -0,0 +1,289 @@
+package fshandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// Directories inside BaseDirectory used by the server itself.  Object files
+// are always named by a hex sha256, so these can never collide with a key.
+const (
+	blobDirName = ".blobs"
+	tmpDirName  = ".tmp"
+)
+
+// DefaultGCInterval is how often unreferenced blobs are collected.
+const DefaultGCInterval = time.Hour
+
+// BlobStats describes how much space deduplication and compression are
+// saving.
+type BlobStats struct {
+	Objects        int64 `json:"objects"`
+	Blobs          int64 `json:"blobs"`
+	Unreferenced   int64 `json:"unreferenced_blobs"`
+	LogicalBytes   int64 `json:"logical_bytes"`
+	PhysicalBytes  int64 `json:"physical_bytes"`
+	SavedBytes     int64 `json:"saved_bytes"`
+	DedupEnabled   bool  `json:"dedup_enabled"`
+	GCIntervalSecs int64 `json:"gc_interval_seconds,omitempty"`
+}
+
+// StatsEndpoint reports logical versus physical storage use to admins.
+// Counting reads every object's metadata, so it is only done when asked
+// for here, and the storage metrics report the last count.
+func (s Server) StatsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+
+	stats, err := s.blobStats()
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+	storageCount.set(stats)
+	respond.With(w, r, http.StatusOK, stats)
+}
+
+func (s Server) tmpDir() string {
+	return path.Join(s.BaseDirectory, tmpDirName)
+}
+
+func (s Server) blobDir() string {
+	return path.Join(s.BaseDirectory, blobDirName)
+}
+
+func (s Server) blobPath(name string) string {
+	return s.Layout.place(s.blobDir(), name)
+}
+
+// stage copies body into a temporary file inside BaseDirectory, returning
+// its path, the hex sha256 of what was written and its size.  The caller
+// owns the temporary file and must remove it.
+func (s Server) stage(ctx context.Context, body io.Reader) (string, string, int64, error) {
+	span, done := s.operation(ctx, "stage")
+	defer done()
+
+	err := os.MkdirAll(s.tmpDir(), 0777)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	file, err := ioutil.TempFile(s.tmpDir(), stagedPrefix("put"))
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), body)
+	span.SetAttribute("storage.bytes", size)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", "", 0, err
+	}
+	return file.Name(), hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// blobName names the blob holding an object's stored bytes.  Compressed
+// bodies are kept apart from uncompressed copies of the same content.
+func blobName(meta *objectMeta) string {
+	if len(meta.Encoding) == 0 {
+		return meta.Digest
+	}
+	return meta.Digest + "." + meta.Encoding
+}
+
+// commit links a staged file into place as target.  With deduplication on,
+// target becomes another hard link to the blob for its content, so the
+// blob's link count doubles as its reference count.  Encrypted objects are
+// never shared since each has its own data key.  An error satisfying
+// os.IsExist is returned if target is already taken.
+func (s Server) commit(ctx context.Context, tmp string, meta *objectMeta, target string) error {
+	defer s.timed(ctx, "commit")()
+
+	if !s.Dedup || meta.Encryption != nil {
+		return os.Link(tmp, target)
+	}
+
+	blob := s.blobPath(blobName(meta))
+	err := os.MkdirAll(path.Dir(blob), 0777)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = os.Link(tmp, blob)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		err = os.Link(blob, target)
+		// The garbage collector may remove an unreferenced blob between the
+		// two links, in which case our staged copy becomes the blob.
+		if os.IsNotExist(err) {
+			continue
+		}
+		return err
+	}
+}
+
+// CollectGarbage removes blobs that no object refers to any more.
+//
+// This is safe against concurrent uploads: an object linked to a blob just
+// before it is removed keeps its data, it simply stops sharing it.
+func (s Server) CollectGarbage() (int, error) {
+	removed := 0
+	err := s.walkBlobs(func(filepath string, info os.FileInfo) error {
+		if linkCount(info) > 1 {
+			return nil
+		}
+		err := os.Remove(filepath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+func (s Server) collectGarbageEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := s.CollectGarbage()
+		if err != nil {
+			log.Printf("Blob garbage collection failed: %s", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("Blob garbage collection removed %d blobs", removed)
+		}
+	}
+}
+
+// blobStats counts every object and blob.  Physical bytes are counted once
+// per inode, however many objects and blobs are linked to it.
+func (s Server) blobStats() (BlobStats, error) {
+	stats := BlobStats{DedupEnabled: s.Dedup}
+	if s.Dedup {
+		stats.GCIntervalSecs = int64(s.gcInterval() / time.Second)
+	}
+
+	counted := map[interface{}]bool{}
+	countPhysical := func(info os.FileInfo) {
+		if id, ok := fileID(info); ok {
+			if counted[id] {
+				return
+			}
+			counted[id] = true
+		}
+		stats.PhysicalBytes += info.Size()
+	}
+
+	err := s.walkObjects(func(p string, info os.FileInfo) error {
+		stats.Objects++
+		stats.LogicalBytes += info.Size()
+		meta, err := s.readMeta(context.Background(), p)
+		if err == nil && meta != nil {
+			stats.LogicalBytes += meta.Size - info.Size()
+		}
+		countPhysical(info)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	err = s.walkBlobs(func(filepath string, info os.FileInfo) error {
+		stats.Blobs++
+		countPhysical(info)
+		if linkCount(info) <= 1 {
+			stats.Unreferenced++
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if stats.LogicalBytes > stats.PhysicalBytes {
+		stats.SavedBytes = stats.LogicalBytes - stats.PhysicalBytes
+	}
+	return stats, nil
+}
+
+func (s Server) gcInterval() time.Duration {
+	if s.GCInterval > 0 {
+		return s.GCInterval
+	}
+	return DefaultGCInterval
+}
+
+// walkObjects calls fn for every object file under BaseDirectory.
+func (s Server) walkObjects(fn func(filepath string, info os.FileInfo) error) error {
+	return filepath.Walk(s.BaseDirectory, func(p string, info os.FileInfo, err error) error {
+		// Objects may be deleted while we walk.
+		if os.IsNotExist(err) && p != s.BaseDirectory {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != s.BaseDirectory && isInternalName(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isKeyName(info.Name()) {
+			return nil
+		}
+		return fn(p, info)
+	})
+}
+
+// walkBlobs calls fn for every blob, wherever the layout put it.
+func (s Server) walkBlobs(fn func(filepath string, info os.FileInfo) error) error {
+	err := filepath.Walk(s.blobDir(), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p != s.blobDir() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(p, info)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// isInternalName reports whether a directory entry belongs to the server
+// rather than holding objects.
+func isInternalName(name string) bool {
+	return len(name) > 0 && name[0] == '.'
+}
+
+// isKeyName reports whether name looks like a key generated by genKey.
+func isKeyName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
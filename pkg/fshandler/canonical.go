@@ -0,0 +1,182 @@
+package fshandler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/drhayt/coatlocker/pkg/audit"
+)
+
+// canonicalKey derives the canonical form of a request URI, which is what
+// object keys are hashed from.  The rules are applied in order:
+//
+//  1. The query string is dropped, so parameters never change the key.
+//  2. The path is percent-decoded, so /a/%62 is /a/b.  An encoded slash
+//     decodes to a real one.
+//  3. The path is cleaned: repeated slashes, . and .. elements and any
+//     trailing slash are removed, so /a//b/ and /a/./c/../b are /a/b.
+//  4. With FoldCase set, the path is lower cased.
+//
+// The result always starts with a slash.
+func (s Server) canonicalKey(uri string) (string, error) {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	decoded, err := url.PathUnescape(uri)
+	if err != nil {
+		return "", err
+	}
+
+	canonical := path.Clean("/" + decoded)
+	if s.FoldCase {
+		canonical = strings.ToLower(canonical)
+	}
+	return canonical, nil
+}
+
+// requestKey returns the canonical key for r and the hashed key it is
+// stored under, telling the audit log which key r is for.  Objects stored
+// before keys were canonicalised are still found under the hash of their
+// raw request URI until Rekey moves them.
+func (s Server) requestKey(r *http.Request) (string, string, error) {
+	canonical, key, err := s.uriKey(r.RequestURI)
+	if err == nil {
+		audit.SetKey(r, canonical)
+	}
+	return canonical, key, err
+}
+
+// uriKey is requestKey for a bare request URI.
+func (s Server) uriKey(uri string) (string, string, error) {
+	canonical, err := s.canonicalKey(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := s.genKey(canonical)
+	if checkFile(s.findPath(key)) != nil {
+		legacy := s.genKey(uri)
+		if legacy != key && checkFile(s.findPath(legacy)) == nil {
+			return canonical, legacy, nil
+		}
+	}
+	return canonical, key, nil
+}
+
+// RekeyReport summarises a run of Rekey.
+type RekeyReport struct {
+	Moved     int
+	Unchanged int
+	// Unknown objects have no record of the URI they were stored under, so
+	// their canonical key can not be worked out.
+	Unknown int
+	// Conflicts are objects whose canonical key is already taken by
+	// another object.  Both are left alone.
+	Conflicts int
+}
+
+// Rekey moves every object stored under the hash of a raw request URI to
+// the hash of its canonical key.  The URI comes from the object's metadata,
+// or failing that from uris, which lists URIs the caller knows were used
+// (from access logs, say).  It moves objects outside the server's key
+// locks, so refuses to run while a server is.  See LockOffline.
+func (s Server) Rekey(uris []string) (RekeyReport, error) {
+	var report RekeyReport
+
+	unlock, err := s.LockOffline()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	ctx := context.Background()
+	known := make(map[string]string, len(uris))
+	for _, uri := range uris {
+		known[s.genKey(uri)] = uri
+	}
+
+	err = s.walkObjects(func(filepath string, info os.FileInfo) error {
+		meta, err := s.readMeta(ctx, filepath)
+		if err != nil {
+			return fmt.Errorf("%s: %s", filepath, err)
+		}
+
+		var uri string
+		switch {
+		case meta != nil:
+			uri = meta.Key
+		case len(known[info.Name()]) != 0:
+			uri = known[info.Name()]
+		default:
+			report.Unknown++
+			return nil
+		}
+
+		canonical, err := s.canonicalKey(uri)
+		if err != nil {
+			report.Unknown++
+			return nil
+		}
+		key := s.genKey(canonical)
+		if key == info.Name() {
+			report.Unchanged++
+			return nil
+		}
+
+		target := s.genPath(key)
+		if checkFile(target) == nil || checkFile(s.flatPath(key)) == nil {
+			report.Conflicts++
+			return nil
+		}
+
+		// Record the canonical key before the move, so the metadata that
+		// arrives at the new path is already right.
+		if meta == nil {
+			meta, err = s.statMeta(ctx, filepath)
+			if err != nil {
+				return fmt.Errorf("%s: %s", filepath, err)
+			}
+		}
+		meta.Key = canonical
+		err = s.writeMeta(ctx, filepath, meta)
+		if err != nil {
+			return fmt.Errorf("%s: %s", filepath, err)
+		}
+
+		moved, err := s.relocate(ctx, filepath, target)
+		if err != nil {
+			return fmt.Errorf("%s: %s", filepath, err)
+		}
+		if moved {
+			report.Moved++
+		} else {
+			report.Conflicts++
+		}
+		return nil
+	})
+	return report, err
+}
+
+// ReadURIFile reads a list of request URIs, one per line, for Rekey.
+func ReadURIFile(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var uris []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) != 0 {
+			uris = append(uris, line)
+		}
+	}
+	return uris, nil
+}
@@ -0,0 +1,146 @@
+package fshandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCertificateCheckInterval is how often a CertificateWatcher looks
+// for a renewed certificate.
+const DefaultCertificateCheckInterval = 10 * time.Second
+
+// CertificateRenewalWindow is how close to expiry the TLS certificate can
+// get before readiness reports it degraded.
+const CertificateRenewalWindow = 7 * 24 * time.Hour
+
+// CertificateWatcher serves the TLS certificate and key from CertFile and
+// KeyFile, loading them again whenever either file changes.  A renewed
+// pair that cannot be loaded, say because only one of the files has been
+// replaced so far, is retried on the next check while the old pair stays
+// in use.
+type CertificateWatcher struct {
+	CertFile string
+	KeyFile  string
+	Interval time.Duration
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+	certMod  time.Time
+	keyMod   time.Time
+	err      error
+}
+
+// NewCertificateWatcher returns a watcher serving the pair in certFile and
+// keyFile, which must load now.
+func NewCertificateWatcher(certFile, keyFile string) (*CertificateWatcher, error) {
+	w := &CertificateWatcher{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Interval: DefaultCertificateCheckInterval,
+	}
+	err := w.Check()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Start keeps checking for a renewed certificate in the background.
+func (w *CertificateWatcher) Start() {
+	if w == nil {
+		return
+	}
+
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultCertificateCheckInterval
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			w.Check()
+		}
+	}()
+}
+
+// Check loads the certificate and key again if either file has changed
+// since they were last loaded.
+func (w *CertificateWatcher) Check() error {
+	if w == nil {
+		return nil
+	}
+
+	certInfo, err := os.Stat(w.CertFile)
+	if err != nil {
+		return w.failed(err)
+	}
+	keyInfo, err := os.Stat(w.KeyFile)
+	if err != nil {
+		return w.failed(err)
+	}
+
+	w.mu.RLock()
+	unchanged := w.cert != nil && certInfo.ModTime().Equal(w.certMod) && keyInfo.ModTime().Equal(w.keyMod)
+	w.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(w.CertFile, w.KeyFile)
+	if err != nil {
+		return w.failed(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return w.failed(err)
+	}
+	cert.Leaf = leaf
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cert = &cert
+	w.notAfter = leaf.NotAfter
+	w.certMod = certInfo.ModTime()
+	w.keyMod = keyInfo.ModTime()
+	w.err = nil
+	log.Printf("Loaded TLS certificate %s, which expires at %s", w.CertFile, leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// failed records why the certificate could not be loaded, logging it once.
+func (w *CertificateWatcher) failed(err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil || w.err.Error() != err.Error() {
+		log.Printf("Unable to load TLS certificate %s: %s", w.CertFile, err)
+	}
+	w.err = err
+	return err
+}
+
+// GetCertificate serves the current certificate, for tls.Config.
+func (w *CertificateWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.cert == nil {
+		return nil, fmt.Errorf("no TLS certificate is loaded")
+	}
+	return w.cert, nil
+}
+
+// NotAfter is when the current certificate expires.  A nil watcher has no
+// certificate, so the zero time.
+func (w *CertificateWatcher) NotAfter() time.Time {
+	if w == nil {
+		return time.Time{}
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.notAfter
+}
@@ -0,0 +1,225 @@
+package fshandler
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionPolicy decides which objects are compressed at rest.
+type CompressionPolicy struct {
+	// Codec is the Content-Encoding used at rest, "gzip" or "zstd".
+	Codec string
+	// MinSize is the smallest object worth compressing.
+	MinSize int64
+	// ContentTypes limits compression to uploads whose Content-Type starts
+	// with one of these prefixes.  Empty means any type.
+	ContentTypes []string
+}
+
+// Validate checks that the policy names a known codec.
+func (p *CompressionPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	_, ok := codecs[p.Codec]
+	if !ok {
+		return fmt.Errorf("unknown compression codec: %q", p.Codec)
+	}
+	return nil
+}
+
+// applies reports whether an object of size bytes and contentType should be
+// compressed.
+func (p *CompressionPolicy) applies(size int64, contentType string) bool {
+	if p == nil || size < p.MinSize {
+		return false
+	}
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+	for _, prefix := range p.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type codec struct {
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		},
+	},
+}
+
+// compressFile writes a compressed copy of the staged file src next to it,
+// returning the new file's path and size.  The caller owns the new file.
+func (s Server) compressFile(ctx context.Context, src, encoding string) (string, int64, error) {
+	defer s.timed(ctx, "compress")()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(path.Dir(src), stagedPrefix("compress"))
+	if err != nil {
+		return "", 0, err
+	}
+	defer out.Close()
+
+	enc, err := codecs[encoding].newWriter(out)
+	if err == nil {
+		_, err = io.Copy(enc, in)
+		if err == nil {
+			err = enc.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, err
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, err
+	}
+	return out.Name(), info.Size(), nil
+}
+
+// decodingReader presents a compressed stream as a seekable stream of its
+// decoded bytes, so http.ServeContent can answer Range requests.  Seeking
+// backwards restarts decoding from the beginning.
+type decodingReader struct {
+	src      io.ReadSeeker
+	encoding string
+	size     int64
+
+	pos int64
+	cur int64
+	dec io.ReadCloser
+}
+
+func newDecodingReader(src io.ReadSeeker, encoding string, size int64) *decodingReader {
+	return &decodingReader{src: src, encoding: encoding, size: size}
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	if d.dec == nil || d.pos < d.cur {
+		err := d.restart()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d.pos > d.cur {
+		n, err := io.CopyN(ioutil.Discard, d.dec, d.pos-d.cur)
+		d.cur += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := d.dec.Read(p)
+	d.cur += int64(n)
+	d.pos = d.cur
+	return n, err
+}
+
+func (d *decodingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decodingReader) restart() error {
+	d.Close()
+
+	_, err := d.src.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	dec, err := codecs[d.encoding].newReader(d.src)
+	if err != nil {
+		return err
+	}
+	d.dec = dec
+	d.cur = 0
+	return nil
+}
+
+// Close releases the decoder.  The underlying stream is left open.
+func (d *decodingReader) Close() error {
+	if d.dec != nil {
+		d.dec.Close()
+		d.dec = nil
+	}
+	return nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows
+// encoding.
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if name != encoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		return q > 0
+	}
+	return false
+}
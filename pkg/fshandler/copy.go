@@ -0,0 +1,128 @@
+package fshandler
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// copyObject handles POST ?copy-from= and ?move-from=, creating the object
+// for key from the object at another path without the data ever leaving
+// the server.  The new key is a hard link to the same file, so a copy costs
+// a metadata write however large the object is.
+//
+// Keys carry no permissions of their own, so any authenticated subject may
+// copy any object it can read to any free key.  The only checks are that
+// an object stored with a customer key needs that key, that a move can not
+// take an object under retention or legal hold, and that the destination
+// is free and the disk not full.  The object keeps its tags but not its
+// retention, which comes from the request as on a PUT.
+func (s Server) copyObject(w http.ResponseWriter, r *http.Request, canonical, key, from string, move bool) {
+	_, fromKey, err := s.uriKey(from)
+	if err != nil || len(from) == 0 {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	if fromKey == key {
+		respond.WithStatus(w, r, http.StatusConflict)
+		return
+	}
+
+	customer, err := customerKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	retention, err := retentionFromHeaders(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	if !s.Space.Admit(0) {
+		respond.WithStatus(w, r, http.StatusInsufficientStorage)
+		return
+	}
+
+	unlock := s.lockKeys(fromKey, key)
+	defer unlock()
+
+	source := s.findPath(fromKey)
+	if checkFile(source) != nil {
+		respond.WithStatus(w, r, http.StatusNotFound)
+		return
+	}
+
+	meta, err := s.statMeta(r.Context(), source)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+	if !checkCustomerKey(meta.Encryption, customer) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+	// A copy would share the file an append writes to.
+	if !move && meta.Appendable && !meta.Sealed {
+		respond.WithStatus(w, r, http.StatusConflict)
+		return
+	}
+	if move && s.locked(meta, r) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+
+	if status := s.keyTaken(r, key); status != 0 {
+		respond.WithStatus(w, r, status)
+		return
+	}
+
+	// The new object gets its own lock; a copy is a new object, a move keeps
+	// its age.
+	moved := *meta
+	meta.Key = canonical
+	meta.Retention = retention
+	meta.LegalHold = false
+	if !move {
+		meta.Created = time.Now().UTC()
+	}
+
+	err = s.indexTags(key, meta.Tags)
+	if err != nil {
+		s.unindexTags(key, meta.Tags)
+		s.respondWriteError(w, r, err)
+		return
+	}
+
+	filepath := s.genPath(key)
+	err = s.placeObject(r.Context(), filepath, meta, func() error {
+		defer s.timed(r.Context(), "link")()
+		return os.Link(source, filepath)
+	})
+	if os.IsExist(err) {
+		s.unindexStaleTags(r.Context(), key, meta.Tags)
+		respond.WithStatus(w, r, http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		s.unindexTags(key, meta.Tags)
+		s.respondWriteError(w, r, err)
+		return
+	}
+
+	s.publish(EventCreated, key, meta)
+
+	if move {
+		err = s.removeObject(r.Context(), fromKey)
+		if err != nil {
+			respond.WithStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+		s.unindexTags(fromKey, meta.Tags)
+		s.publish(EventDeleted, fromKey, &moved)
+	}
+	respond.WithStatus(w, r, http.StatusCreated)
+}
@@ -0,0 +1,110 @@
+package fshandler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Headers used to supply a customer provided encryption key.  The key is a
+// base64 encoded 256 bit AES key and must accompany every PUT, GET and HEAD
+// of an object stored with it.
+const (
+	CustomerKeyHeader       = "X-Coatlocker-Customer-Key"
+	CustomerKeySHA256Header = "X-Coatlocker-Customer-Key-SHA256"
+)
+
+// customerKeyID marks data keys wrapped by a customer key rather than by
+// the server's KeyProvider.
+const customerKeyID = "customer"
+
+// customerKey returns the key supplied with r, or nil if there is none.
+// If the client also sent the key's sha256 it has to match, which catches
+// keys mangled in transit.
+func customerKey(r *http.Request) ([]byte, error) {
+	encoded := r.Header.Get(CustomerKeyHeader)
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("customer key is not base64: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("customer key must be 32 bytes, not %d", len(key))
+	}
+
+	sum := r.Header.Get(CustomerKeySHA256Header)
+	if len(sum) != 0 {
+		expected, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil || !hmac.Equal(expected, customerKeyHash(key)) {
+			return nil, fmt.Errorf("customer key does not match its sha256")
+		}
+	}
+	return key, nil
+}
+
+func customerKeyHash(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:]
+}
+
+// customerKeyFingerprint is what gets stored in place of the key itself.
+func customerKeyFingerprint(key []byte) string {
+	return base64.StdEncoding.EncodeToString(customerKeyHash(key))
+}
+
+// checkCustomerKey reports whether key is the one enc was stored with.
+func checkCustomerKey(enc *encryptionMeta, key []byte) bool {
+	if enc == nil || len(enc.CustomerKeySHA256) == 0 {
+		return true
+	}
+	if key == nil {
+		return false
+	}
+	fingerprint := customerKeyFingerprint(key)
+	return subtle.ConstantTimeCompare([]byte(fingerprint), []byte(enc.CustomerKeySHA256)) == 1
+}
+
+// wrapWithCustomerKey seals dataKey under a customer key.
+func wrapWithCustomerKey(key, dataKey []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(customerKeyID)), nil
+}
+
+// unwrapWithCustomerKey opens a data key sealed by wrapWithCustomerKey.
+func unwrapWithCustomerKey(key, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	nonce := wrapped[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[aead.NonceSize():], []byte(customerKeyID))
+}
+
+// customerDigest keys an object's digest with its customer key, so the
+// stored digest and ETag reveal nothing about the plaintext to anyone
+// without the key.
+func customerDigest(key []byte, digest string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(digest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,192 @@
+package fshandler
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultSpaceCheckInterval is how often a SpaceMonitor polls the filesystem.
+const DefaultSpaceCheckInterval = 10 * time.Second
+
+// SpaceMonitor watches the free space on the filesystem holding a directory.
+//
+// Below LowWatermark free bytes the server reports itself degraded.  Below
+// CriticalWatermark it goes read-only and rejects new uploads, and it stays
+// read-only until free space climbs back above LowWatermark.
+type SpaceMonitor struct {
+	Path              string
+	LowWatermark      uint64
+	CriticalWatermark uint64
+	Interval          time.Duration
+
+	mu       sync.RWMutex
+	free     uint64
+	total    uint64
+	readOnly bool
+	err      error
+}
+
+// SpaceStatus is a point in time view of a SpaceMonitor.
+type SpaceStatus struct {
+	FreeBytes         uint64 `json:"free_bytes"`
+	TotalBytes        uint64 `json:"total_bytes"`
+	LowWatermark      uint64 `json:"low_watermark"`
+	CriticalWatermark uint64 `json:"critical_watermark"`
+	Degraded          bool   `json:"degraded"`
+	ReadOnly          bool   `json:"read_only"`
+	Error             string `json:"error,omitempty"`
+}
+
+// NewSpaceMonitor returns a monitor for the filesystem holding path.
+func NewSpaceMonitor(path string, low, critical uint64) *SpaceMonitor {
+	if low < critical {
+		low = critical
+	}
+	return &SpaceMonitor{
+		Path:              path,
+		LowWatermark:      low,
+		CriticalWatermark: critical,
+		Interval:          DefaultSpaceCheckInterval,
+	}
+}
+
+// Start takes an initial reading and then keeps polling in the background.
+func (m *SpaceMonitor) Start() error {
+	err := m.Check()
+	if err != nil {
+		return err
+	}
+
+	interval := m.Interval
+	if interval <= 0 {
+		interval = DefaultSpaceCheckInterval
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			m.Check()
+		}
+	}()
+	return nil
+}
+
+// Check reads the current free space and updates the read-only state.
+func (m *SpaceMonitor) Check() error {
+	if m == nil {
+		return nil
+	}
+
+	free, total, err := diskFree(m.Path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.err = err
+	if err != nil {
+		log.Printf("Unable to read free space of %s: %s", m.Path, err)
+		return err
+	}
+	m.free = free
+	m.total = total
+
+	switch {
+	case !m.readOnly && free < m.CriticalWatermark:
+		m.readOnly = true
+		log.Printf("Free space on %s is %d bytes, below critical watermark, going read-only", m.Path, free)
+	case m.readOnly && free >= m.LowWatermark:
+		m.readOnly = false
+		log.Printf("Free space on %s is %d bytes, resuming uploads", m.Path, free)
+	}
+	return nil
+}
+
+// SetWatermarks replaces the watermarks and takes a fresh reading against
+// them.
+func (m *SpaceMonitor) SetWatermarks(low, critical uint64) {
+	if m == nil {
+		return
+	}
+	if low < critical {
+		low = critical
+	}
+	m.mu.Lock()
+	m.LowWatermark = low
+	m.CriticalWatermark = critical
+	m.mu.Unlock()
+	m.Check()
+}
+
+// ReadOnly reports whether uploads are currently being refused.
+func (m *SpaceMonitor) ReadOnly() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readOnly
+}
+
+// Degraded reports whether free space is below the low watermark.
+func (m *SpaceMonitor) Degraded() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readOnly || m.free < m.LowWatermark
+}
+
+// Admit reports whether an upload of size bytes may start.  A negative size
+// means the size is unknown, in which case only the read-only state counts.
+func (m *SpaceMonitor) Admit(size int64) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.readOnly {
+		return false
+	}
+	if size < 0 {
+		return true
+	}
+	return m.free >= uint64(size) && m.free-uint64(size) >= m.CriticalWatermark
+}
+
+// Status returns the last reading.
+func (m *SpaceMonitor) Status() SpaceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status := SpaceStatus{
+		FreeBytes:         m.free,
+		TotalBytes:        m.total,
+		LowWatermark:      m.LowWatermark,
+		CriticalWatermark: m.CriticalWatermark,
+		Degraded:          m.readOnly || m.free < m.LowWatermark,
+		ReadOnly:          m.readOnly,
+	}
+	if m.err != nil {
+		status.Error = m.err.Error()
+	}
+	return status
+}
+
+// isNoSpace reports whether err was caused by the filesystem being full,
+// whether it came from opening, writing, linking or syncing a file.
+func isNoSpace(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			return err == syscall.ENOSPC || err == syscall.EDQUOT
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package fshandler
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// encryptionScheme identifies the on-disk format written by encryptFile.
+const encryptionScheme = "aes-256-gcm-chunked"
+
+// encryptChunkSize is how much plaintext goes into each sealed chunk.
+// Chunks are sealed independently so a Range request only has to decrypt
+// the chunks it touches.
+const encryptChunkSize = 64 << 10
+
+// encryptionMeta records how an object was encrypted.
+type encryptionMeta struct {
+	Scheme     string `json:"scheme"`
+	ChunkSize  int    `json:"chunk_size"`
+	KeyID      string `json:"key_id,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	// CustomerKeySHA256 fingerprints the customer provided key the data key
+	// is wrapped with, if any.
+	CustomerKeySHA256 string `json:"customer_key_sha256,omitempty"`
+	// PlainSize is the size of what was encrypted, which is the compressed
+	// size if the object was also compressed.
+	PlainSize int64 `json:"plain_size"`
+}
+
+// encryptFile writes an encrypted copy of src next to it using dataKey,
+// returning the new file's path and size.  The caller owns the new file.
+func encryptFile(src string, dataKey []byte) (string, int64, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", 0, err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	last := lastChunk(info.Size(), encryptChunkSize)
+
+	out, err := ioutil.TempFile(path.Dir(src), stagedPrefix("encrypt"))
+	if err != nil {
+		return "", 0, err
+	}
+	defer out.Close()
+
+	plain := make([]byte, encryptChunkSize)
+	sealed := make([]byte, 0, encryptChunkSize+aead.Overhead())
+	var size int64
+	for index := int64(0); index <= last; index++ {
+		n, err := io.ReadFull(in, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			os.Remove(out.Name())
+			return "", 0, err
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead, index), plain[:n], chunkAAD(index, index == last))
+		_, err = out.Write(sealed)
+		if err != nil {
+			os.Remove(out.Name())
+			return "", 0, err
+		}
+		size += int64(len(sealed))
+	}
+	return out.Name(), size, nil
+}
+
+// newDataKey returns a fresh random data key.
+func newDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// lastChunk returns the index of the final chunk for size bytes of
+// plaintext.  Even empty plaintext is written as one empty chunk so that
+// truncation can always be detected.
+func lastChunk(size int64, chunkSize int) int64 {
+	if size == 0 {
+		return 0
+	}
+	return (size - 1) / int64(chunkSize)
+}
+
+// chunkNonce derives a chunk's nonce from its index.  Every object has its
+// own data key, so nonces never repeat under the same key.
+func chunkNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+// chunkAAD binds a chunk to its position and marks the final chunk, so
+// chunks can be neither reordered nor dropped from the end.
+func chunkAAD(index int64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(index))
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// decryptingReader presents a file written by encryptFile as a seekable
+// stream of its plaintext.
+type decryptingReader struct {
+	src       io.ReadSeeker
+	aead      cipher.AEAD
+	chunkSize int
+	size      int64
+	last      int64
+
+	pos   int64
+	index int64
+	plain []byte
+	buf   []byte
+}
+
+func newDecryptingReader(src io.ReadSeeker, dataKey []byte, enc *encryptionMeta) (*decryptingReader, error) {
+	if enc.Scheme != encryptionScheme {
+		return nil, fmt.Errorf("unknown encryption scheme %q", enc.Scheme)
+	}
+	if enc.ChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid encryption chunk size %d", enc.ChunkSize)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		src:       src,
+		aead:      aead,
+		chunkSize: enc.ChunkSize,
+		size:      enc.PlainSize,
+		last:      lastChunk(enc.PlainSize, enc.ChunkSize),
+		index:     -1,
+		buf:       make([]byte, enc.ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	index := d.pos / int64(d.chunkSize)
+	if index != d.index {
+		err := d.load(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	offset := d.pos - index*int64(d.chunkSize)
+	if offset >= int64(len(d.plain)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, d.plain[offset:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// load reads and authenticates chunk index.
+func (d *decryptingReader) load(index int64) error {
+	sealedSize := int64(d.chunkSize + d.aead.Overhead())
+	_, err := d.src.Seek(index*sealedSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// A chunk missing altogether means the file was cut short, not that
+	// the plaintext has ended.
+	n, err := io.ReadFull(d.src, d.buf)
+	if err == io.EOF {
+		return fmt.Errorf("chunk %d is missing: %s", index, io.ErrUnexpectedEOF)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	d.plain, err = d.aead.Open(d.plain[:0], chunkNonce(d.aead, index), d.buf[:n], chunkAAD(index, index == d.last))
+	if err != nil {
+		return fmt.Errorf("chunk %d failed authentication: %s", index, err)
+	}
+	d.index = index
+	return nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	d.pos = offset
+	return offset, nil
+}
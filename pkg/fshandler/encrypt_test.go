@@ -0,0 +1,216 @@
+package fshandler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptBytes encrypts plain the way an object is stored, returning the
+// encrypted file, the data key and the metadata to read it back with.
+func encryptBytes(t *testing.T, plain []byte) (string, []byte, *encryptionMeta) {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "plain")
+	err := ioutil.WriteFile(src, plain, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, _, err := encryptFile(src, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted, dataKey, &encryptionMeta{
+		Scheme:    encryptionScheme,
+		ChunkSize: encryptChunkSize,
+		PlainSize: int64(len(plain)),
+	}
+}
+
+// decryptFile reads back the whole of a file written by encryptFile.
+func decryptFile(name string, dataKey []byte, enc *encryptionMeta) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := newDecryptingReader(file, dataKey, enc)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptChunkBoundaries(t *testing.T) {
+	for _, size := range []int{
+		0,
+		1,
+		encryptChunkSize - 1,
+		encryptChunkSize,
+		encryptChunkSize + 1,
+		2 * encryptChunkSize,
+		2*encryptChunkSize + 1,
+	} {
+		plain := randomBytes(t, size)
+		encrypted, dataKey, enc := encryptBytes(t, plain)
+
+		info, err := os.Stat(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, _ := newAEAD(dataKey)
+		chunks := lastChunk(int64(size), encryptChunkSize) + 1
+		if want := int64(size) + chunks*int64(aead.Overhead()); info.Size() != want {
+			t.Errorf("%d bytes: encrypted to %d bytes, want %d", size, info.Size(), want)
+		}
+
+		got, err := decryptFile(encrypted, dataKey, enc)
+		if err != nil {
+			t.Errorf("%d bytes: %s", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted to %d different bytes", size, len(got))
+		}
+	}
+}
+
+func TestDecryptSeekAcrossChunks(t *testing.T) {
+	plain := randomBytes(t, 3*encryptChunkSize)
+	encrypted, dataKey, enc := encryptBytes(t, plain)
+
+	file, err := os.Open(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := newDecryptingReader(file, dataKey, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []int64{0, encryptChunkSize - 10, encryptChunkSize, 2*encryptChunkSize + 5} {
+		_, err = reader.Seek(offset, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 20)
+		_, err = io.ReadFull(reader, got)
+		if err != nil {
+			t.Fatalf("reading 20 bytes at %d: %s", offset, err)
+		}
+		if !bytes.Equal(got, plain[offset:offset+20]) {
+			t.Errorf("reading 20 bytes at %d gave the wrong bytes", offset)
+		}
+	}
+}
+
+func TestDecryptDetectsTruncation(t *testing.T) {
+	plain := randomBytes(t, 2*encryptChunkSize+100)
+	encrypted, dataKey, enc := encryptBytes(t, plain)
+	aead, _ := newAEAD(dataKey)
+	sealedChunk := int64(encryptChunkSize + aead.Overhead())
+
+	info, err := os.Stat(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int64{
+		"final chunk dropped":    2 * sealedChunk,
+		"final chunk cut short":  info.Size() - 1,
+		"middle chunk cut short": sealedChunk + 10,
+	} {
+		truncated := filepath.Join(t.TempDir(), "truncated")
+		data, err := ioutil.ReadFile(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(truncated, data[:size], 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = decryptFile(truncated, dataKey, enc)
+		if err == nil {
+			t.Errorf("%s: decrypted without error", name)
+		}
+	}
+}
+
+func TestDecryptDetectsDroppedFinalChunkAtBoundary(t *testing.T) {
+	// With whole chunks only, dropping the last one leaves a file that is
+	// still made of whole chunks, so only the final chunk marker catches it.
+	plain := randomBytes(t, 2*encryptChunkSize)
+	encrypted, dataKey, enc := encryptBytes(t, plain)
+	aead, _ := newAEAD(dataKey)
+
+	data, err := ioutil.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(encrypted, data[:encryptChunkSize+aead.Overhead()], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc.PlainSize = encryptChunkSize
+	_, err = decryptFile(encrypted, dataKey, enc)
+	if err == nil {
+		t.Error("decrypted a file missing its final chunk without error")
+	}
+}
+
+func TestDecryptDetectsReorderedChunks(t *testing.T) {
+	plain := randomBytes(t, 3*encryptChunkSize)
+	encrypted, dataKey, enc := encryptBytes(t, plain)
+	aead, _ := newAEAD(dataKey)
+	sealedChunk := encryptChunkSize + aead.Overhead()
+
+	data, err := ioutil.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var swapped []byte
+	swapped = append(swapped, data[sealedChunk:2*sealedChunk]...)
+	swapped = append(swapped, data[:sealedChunk]...)
+	swapped = append(swapped, data[2*sealedChunk:]...)
+	err = ioutil.WriteFile(encrypted, swapped, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decryptFile(encrypted, dataKey, enc)
+	if err == nil {
+		t.Error("decrypted reordered chunks without error")
+	}
+}
+
+func TestDecryptRefusesWrongKey(t *testing.T) {
+	encrypted, _, enc := encryptBytes(t, randomBytes(t, 100))
+	otherKey, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decryptFile(encrypted, otherKey, enc)
+	if err == nil {
+		t.Error("decrypted with the wrong data key without error")
+	}
+}
@@ -0,0 +1,226 @@
+package fshandler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// DefaultMaxEntrySize is the largest archive entry extract will store when
+// MaxEntrySize is not set.
+const DefaultMaxEntrySize = 1 << 30
+
+// maxExtractEntries bounds how many entries one archive may hold.
+const maxExtractEntries = 10000
+
+var zipMagic = []byte("PK\x03\x04")
+
+// ExtractResult is the outcome for one archive entry.  Status is the code
+// a PUT of the entry on its own would have got.
+type ExtractResult struct {
+	Name   string `json:"name"`
+	Key    string `json:"key,omitempty"`
+	Status int    `json:"status"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// ExtractReport lists what became of every file in an archive.  Error is
+// set if the archive itself could not be read to the end.
+type ExtractReport struct {
+	Created int             `json:"created"`
+	Results []ExtractResult `json:"results"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// extract handles PUT ?extract, storing each file in the tar, tar.gz or
+// zip body as an object under prefix.  Tar is unpacked as it streams in;
+// zip has to be staged first since its directory is at the end.  Entries
+// that would land outside prefix, are not regular files or are bigger than
+// MaxEntrySize are skipped and reported.  Each object gets the retention
+// and tags of base.
+func (s Server) extract(w http.ResponseWriter, r *http.Request, prefix string, base objectMeta, customer []byte) {
+	if !s.Space.Admit(r.ContentLength) {
+		respond.WithStatus(w, r, http.StatusInsufficientStorage)
+		return
+	}
+
+	body := bufio.NewReader(r.Body)
+	magic, _ := body.Peek(len(zipMagic))
+
+	report := ExtractReport{Results: []ExtractResult{}}
+	add := func(name string, size int64, content io.Reader) {
+		result := s.extractEntry(r, prefix, name, size, content, base, customer)
+		if result.Status == http.StatusCreated {
+			report.Created++
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	var err error
+	if bytes.Equal(magic, zipMagic) {
+		err = s.extractZip(r.Context(), body, add)
+	} else {
+		err = extractTar(body, add)
+	}
+	if err != nil {
+		report.Error = err.Error()
+		respond.With(w, r, http.StatusBadRequest, report)
+		return
+	}
+	respond.With(w, r, http.StatusOK, report)
+}
+
+// extractTar calls add for every regular file in the tar, or tar.gz, in
+// body, and for anything else a tar may hold.  Directories are skipped.
+func extractTar(body *bufio.Reader, add func(string, int64, io.Reader)) error {
+	var archive io.Reader = body
+	magic, _ := body.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		decompressor, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		archive = decompressor
+	}
+
+	reader := tar.NewReader(archive)
+	for entries := 0; ; entries++ {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entries == maxExtractEntries {
+			return fmt.Errorf("archive holds more than %d entries", maxExtractEntries)
+		}
+
+		info := header.FileInfo()
+		if info.IsDir() {
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			add(header.Name, -1, nil)
+			continue
+		}
+		add(header.Name, header.Size, reader)
+	}
+}
+
+// extractZip stages the zip in body and calls add for each of its files.
+func (s Server) extractZip(ctx context.Context, body io.Reader, add func(string, int64, io.Reader)) error {
+	tmp, _, _, err := s.stage(ctx, body)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	reader, err := zip.OpenReader(tmp)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if len(reader.File) > maxExtractEntries {
+		return fmt.Errorf("archive holds more than %d entries", maxExtractEntries)
+	}
+	for _, file := range reader.File {
+		info := file.FileInfo()
+		if info.IsDir() {
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			add(file.Name, -1, nil)
+			continue
+		}
+
+		content, err := file.Open()
+		if err != nil {
+			return err
+		}
+		add(file.Name, int64(file.UncompressedSize64), content)
+		content.Close()
+	}
+	return nil
+}
+
+// extractEntry stores one archive entry of the given size under prefix.  A
+// negative size marks an entry that is not a regular file.
+func (s Server) extractEntry(r *http.Request, prefix, name string, size int64, content io.Reader, base objectMeta, customer []byte) ExtractResult {
+	result := ExtractResult{Name: name}
+	canonical, ok := s.entryKey(prefix, name)
+	if !ok || size < 0 {
+		result.Status = http.StatusBadRequest
+		return result
+	}
+	result.Key = canonical
+
+	if size > s.maxEntrySize() {
+		result.Status = http.StatusRequestEntityTooLarge
+		return result
+	}
+
+	key := s.genKey(canonical)
+	if status := s.keyTaken(r, key); status != 0 {
+		result.Status = status
+		return result
+	}
+
+	meta := &objectMeta{
+		Key:         canonical,
+		ContentType: mime.TypeByExtension(path.Ext(name)),
+		Created:     time.Now().UTC(),
+		Retention:   base.Retention,
+		Tags:        base.Tags,
+	}
+	result.Status = s.storeObject(r.Context(), content, key, meta, customer)
+	if result.Status == http.StatusCreated {
+		result.Size = meta.Size
+	}
+	return result
+}
+
+// entryKey returns the canonical key for the archive entry name under
+// prefix.  Absolute names and names climbing out with .. are refused
+// rather than cleaned, since they are never what the uploader meant.
+func (s Server) entryKey(prefix, name string) (string, bool) {
+	if len(name) == 0 || strings.HasPrefix(name, "/") || strings.ContainsAny(name, "\\\x00") {
+		return "", false
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", false
+		}
+	}
+
+	canonical := path.Clean(prefix + "/" + name)
+	if s.FoldCase {
+		canonical = strings.ToLower(canonical)
+	}
+	if !strings.HasPrefix(canonical, strings.TrimSuffix(prefix, "/")+"/") {
+		return "", false
+	}
+	return canonical, true
+}
+
+func (s Server) maxEntrySize() int64 {
+	if max := s.Settings.Load().MaxEntrySize; max > 0 {
+		return max
+	}
+	return DefaultMaxEntrySize
+}
@@ -0,0 +1,164 @@
+package fshandler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEntryKey(t *testing.T) {
+	s := Server{}
+	for _, test := range []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{"a.txt", "/p/a.txt", true},
+		{"d/b.txt", "/p/d/b.txt", true},
+		{"./d//b.txt", "/p/d/b.txt", true},
+		{"../x", "", false},
+		{"d/../../x", "", false},
+		{"d/../x", "", false},
+		{"..", "", false},
+		{"/etc/passwd", "", false},
+		{"//etc/passwd", "", false},
+		{"d\\..\\x", "", false},
+		{"a\x00b", "", false},
+		{"", "", false},
+		{".", "", false},
+	} {
+		key, ok := s.entryKey("/p", test.name)
+		if ok != test.ok || key != test.key {
+			t.Errorf("entryKey(%q) = %q, %v, want %q, %v", test.name, key, ok, test.key, test.ok)
+		}
+	}
+}
+
+func TestEntryKeyFoldsCase(t *testing.T) {
+	s := Server{FoldCase: true}
+	key, ok := s.entryKey("/p", "Dir/File.TXT")
+	if !ok || key != "/p/dir/file.txt" {
+		t.Errorf("entryKey = %q, %v, want /p/dir/file.txt, true", key, ok)
+	}
+}
+
+// archiveEntry is a file to put in a test archive.
+type archiveEntry struct {
+	name    string
+	content string
+}
+
+func buildTar(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		err := archive.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = archive.Write([]byte(entry.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func buildZip(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		file, err := archive.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.Write([]byte(entry.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractRefusesEscapingEntries(t *testing.T) {
+	entries := []archiveEntry{
+		{"ok.txt", "fine"},
+		{"../escaped.txt", "outside"},
+		{"d/../../escaped.txt", "outside"},
+		{"/absolute.txt", "outside"},
+	}
+	want := map[string]int{
+		"ok.txt":              http.StatusCreated,
+		"../escaped.txt":      http.StatusBadRequest,
+		"d/../../escaped.txt": http.StatusBadRequest,
+		"/absolute.txt":       http.StatusBadRequest,
+	}
+
+	for format, archive := range map[string][]byte{
+		"tar": buildTar(t, entries),
+		"zip": buildZip(t, entries),
+	} {
+		base := t.TempDir()
+		s := Server{BaseDirectory: base}
+		r := httptest.NewRequest(http.MethodPut, "/p?extract", bytes.NewReader(archive))
+		w := httptest.NewRecorder()
+		s.extract(w, r, "/p", objectMeta{}, nil)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: extract answered %d: %s", format, w.Code, w.Body)
+		}
+		var report ExtractReport
+		err := json.Unmarshal(w.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if len(report.Results) != len(entries) {
+			t.Errorf("%s: reported %d entries, want %d", format, len(report.Results), len(entries))
+		}
+		if report.Created != 1 {
+			t.Errorf("%s: created %d objects, want 1", format, report.Created)
+		}
+		for _, result := range report.Results {
+			if result.Status != want[result.Name] {
+				t.Errorf("%s: %q got %d, want %d", format, result.Name, result.Status, want[result.Name])
+			}
+		}
+
+		// Only the one good entry may have been stored, and nothing may
+		// have been written beside the base directory.
+		for _, key := range []string{"/escaped.txt", "/absolute.txt", "/p/escaped.txt"} {
+			if checkFile(s.findPath(s.genKey(key))) == nil {
+				t.Errorf("%s: %s was stored", format, key)
+			}
+		}
+		if checkFile(s.findPath(s.genKey("/p/ok.txt"))) != nil {
+			t.Errorf("%s: /p/ok.txt was not stored", format)
+		}
+		outside, err := filepath.Glob(filepath.Join(filepath.Dir(base), "*escaped*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outside) != 0 {
+			t.Errorf("%s: wrote %v outside the base directory", format, outside)
+		}
+		if _, err := os.Stat(filepath.Join(base, "..", "absolute.txt")); err == nil {
+			t.Errorf("%s: wrote absolute.txt outside the base directory", format)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package fshandler
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
+	"strconv"
+	"time"
 
+	"github.com/drhayt/coatlocker/pkg/metrics"
 	respond "gopkg.in/matryer/respond.v1"
 )
 
@@ -18,88 +22,473 @@ type Server struct {
 	CertFile      string
 	KeyFile       string
 	JWTCertFile   string
+
+	// Certificate, when set, serves CertFile and KeyFile to TLS, reloading
+	// them when they are renewed.
+	Certificate *CertificateWatcher
+
+	// Space, when set, guards uploads against filling the disk.
+	Space *SpaceMonitor
+
+	// Dedup stores object bodies once per content hash, with each key a hard
+	// link to the shared blob.  GCInterval controls how often unreferenced
+	// blobs are removed.
+	Dedup      bool
+	GCInterval time.Duration
+
+	// Encryption, when set, encrypts new objects at rest under per-object
+	// data keys wrapped by its master key.
+	Encryption KeyProvider
+
+	// Layout spreads objects and blobs over nested directories.
+	Layout Layout
+
+	// FoldCase makes keys case insensitive.  See canonicalKey.
+	FoldCase bool
+
+	// TrashRetention, when set, turns DELETE into a soft delete: objects
+	// move to the trash, can be undeleted, and are purged once they have
+	// been there this long.
+	TrashRetention time.Duration
+
+	// Settings holds the admins, limits and compression policy, which can
+	// be changed while the server runs.
+	Settings *LiveSettings
+
+	// Events, when set, sends object changes to webhooks.
+	Events *Notifier
+
+	// Watchers, when set, lets clients watch for object changes and wait
+	// for objects to appear.
+	Watchers *Watchers
+
+	// Metrics, when set, collects storage totals and backend operation
+	// timings.
+	Metrics *metrics.Registry
+
+	// Drain, when set, tells the server it is shutting down.
+	Drain *Drain
 }
 
-// HealthEndpoint is an endpoint to allow for health monitoring.
-func (s Server) HealthEndpoint(w http.ResponseWriter, r *http.Request) {
-	respond.WithStatus(w, r, http.StatusOK)
+// Start launches the server's background jobs, after clearing away any
+// uploads a server that died was staging.  See StaleStagedAge.
+func (s Server) Start() error {
+	startHeartbeat()
+
+	err := s.lockShared()
+	if err != nil {
+		return err
+	}
+	err = s.openKeyLocks()
+	if err != nil {
+		return err
+	}
+	err = s.recordLayout()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.removeStagedStale()
+	if err != nil {
+		return err
+	}
+
+	if s.Space != nil {
+		err = s.Space.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Certificate.Start()
+
+	if s.Dedup {
+		go s.collectGarbageEvery(s.gcInterval())
+	}
 
+	if s.TrashRetention > 0 {
+		go s.purgeTrashEvery(DefaultPurgeInterval)
+	}
+
+	if s.Metrics != nil {
+		s.startMetrics()
+	}
+
+	return s.Events.Start()
+}
+
+// HealthEndpoint is an endpoint to allow for health monitoring.  It also
+// says when the TLS certificate expires.  Low disk space is reported as
+// degraded; once storage is critical and uploads are refused the server
+// answers 503.
+func (s Server) HealthEndpoint(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	health := map[string]interface{}{
+		"status": http.StatusText(http.StatusOK),
+	}
+	if s.Space.Degraded() {
+		health["status"] = "Degraded"
+		health["disk"] = s.Space.Status()
+	}
+	if s.Space.ReadOnly() {
+		code = http.StatusServiceUnavailable
+		health["status"] = "Read only"
+	}
+	health["code"] = code
+	if s.Certificate != nil {
+		health["certificate_expires"] = s.Certificate.NotAfter()
+	}
+	respond.With(w, r, code, health)
 }
 
 // DeleteEndpoint handles deleting a file if it exists.
 func (s Server) DeleteEndpoint(w http.ResponseWriter, r *http.Request) {
 
-	key := s.genKey(r.RequestURI)
-	filepath := s.genPath(key)
+	_, key, err := s.requestKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	respond.WithStatus(w, r, s.deleteKey(r, key))
+}
+
+// deleteKey deletes the object for key on behalf of r, returning the
+// status to report.
+func (s Server) deleteKey(r *http.Request, key string) int {
+	unlock := s.lockKey(key)
+	defer unlock()
 
 	// Dont try to get a file that does not exists.
+	filepath := s.findPath(key)
 	err := checkFile(filepath)
 	if err != nil {
-		respond.WithStatus(w, r, http.StatusNotFound)
-		return
+		return http.StatusNotFound
+	}
+
+	// Locked objects stay put, soft delete or not.
+	meta, err := s.readMeta(r.Context(), filepath)
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	if s.locked(meta, r) {
+		return http.StatusForbidden
 	}
 
 	// Ok, its there, actually remove it.
-	err = os.Remove(filepath)
+	if s.TrashRetention > 0 {
+		err = s.trashObject(r.Context(), key, filepath)
+	} else {
+		err = s.removeObject(r.Context(), key)
+	}
 	if err != nil {
-		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return http.StatusInternalServerError
+	}
+	if meta != nil {
+		s.unindexTags(key, meta.Tags)
+	}
+	s.publish(EventDeleted, key, meta)
+	return http.StatusOK
+}
+
+// PostEndpoint performs an operation on a key, chosen by query parameter:
+//
+//	?undelete[=id]      restore the object from the trash
+//	?retention          set retention from the retention headers
+//	?legal-hold=on|off  place or lift a legal hold, admins only
+//	?copy-from=path     copy the object at path to this key
+//	?move-from=path     move the object at path to this key
+//	?append&offset=n    append the body to an appendable object
+//	?seal               stop appends to an appendable object
+//	?tags               replace the tags with those in the tagging header
+func (s Server) PostEndpoint(w http.ResponseWriter, r *http.Request) {
+
+	canonical, key, err := s.requestKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
 		return
 	}
-	respond.WithStatus(w, r, http.StatusOK)
+
+	query := r.URL.Query()
+	switch {
+	case hasParam(query, "undelete"):
+		s.undelete(w, r, key, query.Get("undelete"))
+	case hasParam(query, "retention"):
+		s.setRetention(w, r, key)
+	case hasParam(query, "legal-hold"):
+		s.setLegalHold(w, r, key, query.Get("legal-hold"))
+	case hasParam(query, "copy-from"):
+		s.copyObject(w, r, canonical, key, query.Get("copy-from"), false)
+	case hasParam(query, "move-from"):
+		s.copyObject(w, r, canonical, key, query.Get("move-from"), true)
+	case hasParam(query, "append"):
+		s.appendObject(w, r, canonical, key, hasParam(query, "seal"))
+	case hasParam(query, "seal"):
+		s.sealObject(w, r, key)
+	case hasParam(query, "tags"):
+		s.setTags(w, r, key)
+	default:
+		respond.WithStatus(w, r, http.StatusBadRequest)
+	}
 }
 
 // GetEndpoint is the endpoint that does stuff.
 func (s Server) GetEndpoint(w http.ResponseWriter, r *http.Request) {
 
-	key := s.genKey(r.RequestURI)
-	filepath := s.genPath(key)
+	_, key, err := s.requestKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	filepath := s.findPath(key)
 
-	// Dont try to get a file that does not exists.
-	err := checkFile(filepath)
+	// Dont try to get a file that does not exists, unless asked to wait
+	// for it.
+	err = checkFile(filepath)
+	if err != nil && hasParam(r.URL.Query(), "wait") {
+		var wait time.Duration
+		wait, err = waitDuration(r)
+		if err != nil {
+			respond.WithStatus(w, r, http.StatusBadRequest)
+			return
+		}
+		if s.waitFor(r, key, wait) {
+			filepath = s.findPath(key)
+		}
+		err = checkFile(filepath)
+	}
 	if err != nil {
 		respond.WithStatus(w, r, http.StatusNotFound)
 		return
 	}
 
+	meta, err := s.statMeta(r.Context(), filepath)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	customer, err := customerKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+	if !checkCustomerKey(meta.Encryption, customer) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+
+	if len(meta.ContentType) != 0 {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	setRetentionHeaders(w, meta)
+	setTagHeaders(w, meta)
+
+	// Only appendable objects, which are always stored as plain bytes, can
+	// be followed.  Anything else is finished, so is simply sent.
+	if r.Method == "GET" && hasParam(r.URL.Query(), "follow") && meta.Appendable {
+		s.follow(w, r, key, meta)
+		return
+	}
+
+	// Compressed objects go out as stored if the client can take them,
+	// otherwise they are decoded on the fly.  Range requests always address
+	// the decoded bytes.
+	sendEncoded := len(meta.Encoding) != 0 &&
+		len(r.Header.Get("Range")) == 0 &&
+		acceptsEncoding(r.Header.Get("Accept-Encoding"), meta.Encoding)
+
 	// It must exist, so open it up.
-	file, err := os.Open(filepath)
+	var content *objectReader
+	if sendEncoded {
+		content, err = s.openEncoded(r.Context(), filepath, meta, customer)
+	} else {
+		content, err = s.openDecoded(r.Context(), filepath, meta, customer)
+	}
 	if err != nil {
 		respond.WithStatus(w, r, http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	defer content.Close()
+
+	etag := meta.etag("")
+	if len(meta.Encoding) != 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if sendEncoded {
+		w.Header().Set("Content-Encoding", meta.Encoding)
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.encodedSize(), 10))
+		etag = meta.etag(meta.Encoding)
+	}
+	if len(etag) != 0 {
+		w.Header().Set("ETag", etag)
+	}
 
-	// Stuff must be good.
-	w.WriteHeader(http.StatusOK)
 	// Lets stream some bytes.
-	// _, err = io.Copy(w, file)
-	// we dont care if this fails.
-	// respond.With(w, r, http.StatusInternalServerError, file.
-	io.Copy(w, file)
-	return
+	http.ServeContent(w, r, "", meta.Created, content)
 }
 
 // PutEndpoint is the endpoint that does stuff.
 func (s Server) PutEndpoint(w http.ResponseWriter, r *http.Request) {
 
-	key := s.genKey(r.RequestURI)
-	filepath := s.genPath(key)
+	canonical, key, err := s.requestKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
 
-	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	customer, err := customerKey(r)
 	if err != nil {
-		respond.WithStatus(w, r, http.StatusUnprocessableEntity)
+		respond.WithStatus(w, r, http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-	defer r.Body.Close()
 
-	_, err = io.Copy(file, r.Body)
+	retention, err := retentionFromHeaders(r)
 	if err != nil {
-		respond.WithStatus(w, r, http.StatusInternalServerError)
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	tags, err := tagsFromHeader(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	// Refuse up front rather than failing halfway through.
+	if !s.Space.Admit(r.ContentLength) {
+		respond.WithStatus(w, r, http.StatusInsufficientStorage)
 		return
 	}
-	respond.WithStatus(w, r, http.StatusCreated)
 
+	// An archive to unpack under the key rather than store as is.
+	if hasParam(r.URL.Query(), "extract") {
+		defer r.Body.Close()
+		s.extract(w, r, canonical, objectMeta{Retention: retention, Tags: tags}, customer)
+		return
+	}
+
+	// Dont bother reading the body if the key is taken.
+	if status := s.keyTaken(r, key); status != 0 {
+		respond.WithStatus(w, r, status)
+		return
+	}
+	defer r.Body.Close()
+
+	meta := &objectMeta{
+		Key:         canonical,
+		ContentType: r.Header.Get("Content-Type"),
+		Created:     time.Now().UTC(),
+		Retention:   retention,
+		Tags:        tags,
+	}
+	respond.WithStatus(w, r, s.storeObject(r.Context(), r.Body, key, meta, customer))
+
+}
+
+// keyTaken returns the status to refuse a new object for key with, or 0 if
+// the key is free.  A locked object says so, since it can not be deleted
+// to make way.
+func (s Server) keyTaken(r *http.Request, key string) int {
+	existing := s.findPath(key)
+	if checkFile(existing) != nil {
+		return 0
+	}
+	meta, _ := s.readMeta(r.Context(), existing)
+	if s.locked(meta, r) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// storeObject stores body as the object for key, filling in the size and
+// digest of meta, and returns the status to report.  customer is the
+// customer provided key to encrypt it with, if any.
+func (s Server) storeObject(ctx context.Context, body io.Reader, key string, meta *objectMeta, customer []byte) int {
+	filepath := s.genPath(key)
+
+	// Stage the upload so a failure never leaves a partial object behind.
+	tmp, digest, size, err := s.stage(ctx, body)
+	if err != nil {
+		return s.writeErrorStatus(err)
+	}
+	defer os.Remove(tmp)
+
+	meta.Size = size
+	meta.Digest = digest
+	meta.StoredSize = size
+
+	stored := tmp
+	compression := s.Settings.Load().Compression
+	if compression.applies(size, meta.ContentType) {
+		compressed, compressedSize, err := s.compressFile(ctx, tmp, compression.Codec)
+		if err != nil {
+			return s.writeErrorStatus(err)
+		}
+		defer os.Remove(compressed)
+
+		// Only keep it if it actually helped.
+		if compressedSize < size {
+			stored = compressed
+			meta.Encoding = compression.Codec
+			meta.StoredSize = compressedSize
+		}
+	}
+
+	if customer != nil {
+		meta.Digest = customerDigest(customer, meta.Digest)
+	}
+
+	if s.Encryption != nil || customer != nil {
+		encrypted, encryptedSize, err := s.encrypt(ctx, stored, meta, customer)
+		if err != nil {
+			return s.writeErrorStatus(err)
+		}
+		defer os.Remove(encrypted)
+		stored = encrypted
+		meta.StoredSize = encryptedSize
+	}
+
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	if checkFile(s.findPath(key)) == nil {
+		return http.StatusUnprocessableEntity
+	}
+
+	err = s.indexTags(key, meta.Tags)
+	if err != nil {
+		return s.writeErrorStatus(err)
+	}
+
+	err = s.placeObject(ctx, filepath, meta, func() error {
+		return s.commit(ctx, stored, meta, filepath)
+	})
+	if os.IsExist(err) {
+		s.unindexStaleTags(ctx, key, meta.Tags)
+		return http.StatusUnprocessableEntity
+	}
+	if err != nil {
+		s.unindexTags(key, meta.Tags)
+		return s.writeErrorStatus(err)
+	}
+	s.publish(EventCreated, key, meta)
+	return http.StatusCreated
+}
+
+// respondWriteError reports a failure to store an upload, telling the client
+// when it was down to running out of space.
+func (s Server) respondWriteError(w http.ResponseWriter, r *http.Request, err error) {
+	respond.WithStatus(w, r, s.writeErrorStatus(err))
+}
+
+// writeErrorStatus is the status for a failure to store an upload.
+func (s Server) writeErrorStatus(err error) int {
+	if isNoSpace(err) {
+		s.Space.Check()
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
 }
 
 // Validate validates that the server is proper.
@@ -124,9 +513,34 @@ func (s Server) Validate() error {
 		return err
 	}
 
+	err = s.Settings.Load().Compression.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = s.Layout.Validate()
+	if err != nil {
+		return err
+	}
+
+	if s.Dedup && !linkCountSupported {
+		return fmt.Errorf("deduplication is not supported on this platform")
+	}
+
+	err = s.Events.Validate()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// hasParam reports whether a query parameter is present, even if empty.
+func hasParam(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
 // Genkey generates a key to be used inside of other function.s
 func (s Server) genKey(URI string) string {
 	hasher := sha256.New()
@@ -136,7 +550,7 @@ func (s Server) genKey(URI string) string {
 }
 
 func (s Server) genPath(Key string) string {
-	return path.Join(s.BaseDirectory, Key)
+	return s.Layout.place(s.BaseDirectory, Key)
 }
 
 // Err unless a directory exists.
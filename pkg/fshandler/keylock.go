@@ -0,0 +1,91 @@
+package fshandler
+
+import (
+	"hash/fnv"
+	"os"
+	"path"
+	"sync"
+)
+
+// keyLockName is the file in BaseDirectory standing for the key locks, one
+// byte per lock, so other servers and maintenance tools sharing the
+// directory take the same locks as this process.
+const keyLockName = ".keylocks"
+
+// keyLocks serialises changes to the same object within this process, so an
+// object's data and metadata are always updated together.
+var keyLocks [256]sync.Mutex
+
+var (
+	// keyLockFiles holds the open key lock file of each BaseDirectory.
+	// They stay open while the process lives, since closing one would drop
+	// every lock this process holds on it.
+	keyLockFilesMu sync.Mutex
+	keyLockFiles   = map[string]*os.File{}
+)
+
+// openKeyLocks opens the key lock file, after which the key locks taken for
+// BaseDirectory also hold against other processes.  Until then they only
+// hold within this one.
+func (s Server) openKeyLocks() error {
+	keyLockFilesMu.Lock()
+	defer keyLockFilesMu.Unlock()
+	if keyLockFiles[s.BaseDirectory] != nil {
+		return nil
+	}
+	file, err := os.OpenFile(path.Join(s.BaseDirectory, keyLockName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	keyLockFiles[s.BaseDirectory] = file
+	return nil
+}
+
+func (s Server) keyLockFile() *os.File {
+	keyLockFilesMu.Lock()
+	defer keyLockFilesMu.Unlock()
+	return keyLockFiles[s.BaseDirectory]
+}
+
+// keyLock returns the index of the lock guarding key.
+func keyLock(key string) uint32 {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+	return hasher.Sum32() % uint32(len(keyLocks))
+}
+
+// lockKey locks key and returns the function that unlocks it.
+func (s Server) lockKey(key string) func() {
+	return s.lockIndex(keyLock(key))
+}
+
+// lockKeys locks two keys at once and returns the function that unlocks
+// them.  The locks are always taken in the same order so two requests
+// locking the same pair can not deadlock.
+func (s Server) lockKeys(a, b string) func() {
+	first, second := keyLock(a), keyLock(b)
+	if first == second {
+		return s.lockIndex(first)
+	}
+	if first > second {
+		first, second = second, first
+	}
+	unlockFirst := s.lockIndex(first)
+	unlockSecond := s.lockIndex(second)
+	return func() {
+		unlockSecond()
+		unlockFirst()
+	}
+}
+
+// lockIndex takes the key lock at index i, first within this process and
+// then against others.
+func (s Server) lockIndex(i uint32) func() {
+	file := s.keyLockFile()
+	keyLocks[i].Lock()
+	lockByte(file, int64(i), true)
+	return func() {
+		lockByte(file, int64(i), false)
+		keyLocks[i].Unlock()
+	}
+}
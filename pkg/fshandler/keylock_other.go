@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fshandler
+
+import "os"
+
+// lockByte can not lock on this platform, so key locks only hold within
+// the process.
+func lockByte(file *os.File, i int64, lock bool) {}
@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package fshandler
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockByte takes, waiting for it, or releases the write lock on byte i of
+// file.  These are fcntl locks, which belong to the process, so the key
+// lock within the process must be held around them.  A nil file locks
+// nothing.
+func lockByte(file *os.File, i int64, lock bool) {
+	if file == nil {
+		return
+	}
+	how := int16(syscall.F_WRLCK)
+	if !lock {
+		how = syscall.F_UNLCK
+	}
+	region := syscall.Flock_t{Type: how, Whence: 0, Start: i, Len: 1}
+	for {
+		err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLKW, &region)
+		// Deadlock detection works per process, not per goroutine, so it
+		// can see a cycle where there is none.  Back off and try again.
+		if err == syscall.EINTR || err == syscall.EDEADLK {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if err != nil {
+			log.Printf("Unable to lock %s: %s", file.Name(), err)
+		}
+		return
+	}
+}
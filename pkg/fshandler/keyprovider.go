@@ -0,0 +1,127 @@
+package fshandler
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps the per-object data keys used for
+// encryption at rest.  The master keys never leave the provider, so a KMS
+// can stand in for the local key file.
+type KeyProvider interface {
+	// CurrentKeyID names the master key new data keys are wrapped with.
+	CurrentKeyID() string
+	// WrapKey encrypts dataKey under the current master key.
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped under the master key keyID.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// FileKeyProvider is a KeyProvider backed by master keys in a local file.
+//
+// Each non-blank line of the file that does not start with # holds a key id
+// and a base64 encoded 32 byte key, separated by whitespace.  The first key
+// wraps new data keys; the rest are kept so older objects can still be read
+// until their keys are rotated.
+type FileKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewFileKeyProvider loads master keys from path.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	provider := &FileKeyProvider{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key id and a key", path, line)
+		}
+		id := fields[0]
+		if _, ok := provider.keys[id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %q", path, line, id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: key is not base64: %s", path, line, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key must be 32 bytes, not %d", path, line, len(key))
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		provider.keys[id] = aead
+		if len(provider.current) == 0 {
+			provider.current = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(provider.current) == 0 {
+		return nil, fmt.Errorf("%s: no keys found", path)
+	}
+	return provider, nil
+}
+
+// CurrentKeyID returns the id of the first key in the file.
+func (p *FileKeyProvider) CurrentKeyID() string {
+	return p.current
+}
+
+// WrapKey seals dataKey with the current master key.
+func (p *FileKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	aead := p.keys[p.current]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", nil, err
+	}
+	return p.current, aead.Seal(nonce, nonce, dataKey, []byte(p.current)), nil
+}
+
+// UnwrapKey opens a data key sealed by WrapKey.
+func (p *FileKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	nonce := wrapped[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
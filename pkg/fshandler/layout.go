@@ -0,0 +1,257 @@
+package fshandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// Layout controls how object files are spread over directories.  With
+// Levels of 2 and Width of 2 the object abcdef... lives at ab/cd/abcdef...
+// The zero Layout puts every object directly in BaseDirectory.
+type Layout struct {
+	Levels int
+	Width  int
+}
+
+// Validate checks that the layout fits inside a key.
+func (l Layout) Validate() error {
+	if l.Levels < 0 || l.Width < 0 {
+		return fmt.Errorf("shard levels and width must not be negative")
+	}
+	if l.Levels > 0 && l.Width == 0 {
+		return fmt.Errorf("shard width must be set when sharding")
+	}
+	if l.Levels*l.Width > 16 {
+		return fmt.Errorf("shard levels times width must be at most 16")
+	}
+	return nil
+}
+
+// dirs returns the directories name is sharded into.
+func (l Layout) dirs(name string) []string {
+	dirs := make([]string, 0, l.Levels)
+	for i := 0; i < l.Levels; i++ {
+		dirs = append(dirs, name[i*l.Width:(i+1)*l.Width])
+	}
+	return dirs
+}
+
+// place joins name onto dir according to the layout.
+func (l Layout) place(dir, name string) string {
+	return path.Join(append(append([]string{dir}, l.dirs(name)...), name)...)
+}
+
+// flatPath is where an object lived before sharding.
+func (s Server) flatPath(key string) string {
+	return path.Join(s.BaseDirectory, key)
+}
+
+// findPath returns where the object for key currently is.  Objects still
+// waiting to be moved by MigrateLayout are found at their flat path; if the
+// object does not exist at all its sharded path is returned.
+func (s Server) findPath(key string) string {
+	filepath := s.genPath(key)
+	if s.Layout.Levels == 0 || checkFile(filepath) == nil {
+		return filepath
+	}
+
+	flat := s.flatPath(key)
+	if checkFile(flat) == nil {
+		return flat
+	}
+	return filepath
+}
+
+// removeObject deletes every copy of the object for key along with its
+// metadata.  The flat copy goes first, so a concurrent MigrateLayout can
+// never move it back into place after the sharded copy is gone.
+func (s Server) removeObject(ctx context.Context, key string) error {
+	defer s.timed(ctx, "remove")()
+
+	paths := []string{s.genPath(key)}
+	if s.Layout.Levels != 0 {
+		paths = []string{s.flatPath(key), s.genPath(key)}
+	}
+
+	for _, filepath := range paths {
+		err := os.Remove(filepath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		os.Remove(metaPath(filepath))
+	}
+	return nil
+}
+
+// MigrateLayout moves objects and blobs that are not where the current
+// layout puts them, and can run while servers are serving the directory.
+// Servers find objects at either path, and each object is moved under its
+// key lock, so it is never missing or seen without its metadata.  Running
+// servers must already be using the layout being migrated to.
+func (s Server) MigrateLayout() (int, error) {
+	err := s.checkLayout()
+	if err != nil {
+		return 0, err
+	}
+	err = s.openKeyLocks()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	moved := 0
+	err = s.walkObjects(func(filepath string, info os.FileInfo) error {
+		target := s.genPath(info.Name())
+		if filepath == target {
+			return nil
+		}
+		unlock := s.lockKey(info.Name())
+		defer unlock()
+		ok, err := s.relocate(ctx, filepath, target)
+		if ok {
+			moved++
+		}
+		return err
+	})
+	if err != nil {
+		return moved, err
+	}
+
+	// Blobs are only ever linked from, never changed, so need no lock.
+	err = s.walkBlobs(func(filepath string, info os.FileInfo) error {
+		target := s.blobPath(info.Name())
+		if filepath == target {
+			return nil
+		}
+		ok, err := s.relocate(ctx, filepath, target)
+		if ok {
+			moved++
+		}
+		return err
+	})
+	return moved, err
+}
+
+// layoutName is the file in BaseDirectory recording the layout servers
+// were last started with.
+const layoutName = ".layout"
+
+// recordLayout notes the layout a server is starting with, for
+// MigrateLayout to check against.
+func (s Server) recordLayout() error {
+	data, err := json.Marshal(s.Layout)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path.Join(s.BaseDirectory, layoutName), data)
+}
+
+// checkLayout makes sure no server is running with a layout other than
+// the one to migrate to.  Objects moved out of a running server's layout
+// would disappear from it.
+func (s Server) checkLayout() error {
+	unlock, err := s.LockOffline()
+	if err == nil {
+		unlock()
+		return nil
+	}
+	if err != ErrStorageInUse {
+		return err
+	}
+
+	var running Layout
+	data, err := ioutil.ReadFile(path.Join(s.BaseDirectory, layoutName))
+	if err == nil {
+		err = json.Unmarshal(data, &running)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to tell which layout the running servers use: %s", err)
+	}
+	if running != s.Layout {
+		return fmt.Errorf("running servers use %d levels of width %d; restart them with the new layout first", running.Levels, running.Width)
+	}
+	return nil
+}
+
+// relocate moves the file at from, and its metadata if any, to to,
+// reporting whether it did.  Objects must be locked by the caller.
+// Metadata goes first so nobody ever sees the data without it, and only
+// once nothing else is found at to.
+func (s Server) relocate(ctx context.Context, from, to string) (bool, error) {
+	defer s.timed(ctx, "relocate")()
+
+	err := os.MkdirAll(path.Dir(to), 0777)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Lstat(to)
+	switch {
+	case err == nil && sameFile(from, to):
+		// A previous run was interrupted after linking.  Any metadata at
+		// to has been kept up to date since, so only missing metadata is
+		// brought along.
+		err = os.Link(metaPath(from), metaPath(to))
+		if err != nil && !os.IsNotExist(err) && !os.IsExist(err) {
+			return false, err
+		}
+	case err == nil:
+		log.Printf("Not moving %s, %s already exists", from, to)
+		return false, nil
+	case !os.IsNotExist(err):
+		return false, err
+	default:
+		linkedMeta := true
+		err = os.Link(metaPath(from), metaPath(to))
+		if os.IsNotExist(err) {
+			linkedMeta, err = false, nil
+		}
+		if os.IsExist(err) {
+			log.Printf("Not moving %s, %s already exists", from, metaPath(to))
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		err = os.Link(from, to)
+		if err != nil && linkedMeta {
+			os.Remove(metaPath(to))
+		}
+		if os.IsNotExist(err) {
+			// Deleted underneath us.
+			return false, nil
+		}
+		if os.IsExist(err) {
+			log.Printf("Not moving %s, %s already exists", from, to)
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = os.Remove(from)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	os.Remove(metaPath(from))
+	return true, nil
+}
+
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
@@ -0,0 +1,207 @@
+package fshandler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drhayt/coatlocker/pkg/identity"
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// leaseDirName holds lease state inside BaseDirectory.
+const leaseDirName = ".leases"
+
+// LeasePrefix is the path leases are named under.
+const LeasePrefix = "/_leases/"
+
+// Lease TTLs, used when acquiring or renewing without ?ttl= and as the
+// longest allowed.
+const (
+	DefaultLeaseTTL = 30 * time.Second
+	MaxLeaseTTL     = time.Hour
+)
+
+// maxLeaseName bounds the length of a lease name.
+const maxLeaseName = 1024
+
+// Lease is a named lock held by one JWT subject until it expires.  Token
+// goes up by one every time the lease is acquired and is never reused, so
+// it can fence off writes from a holder that lost the lease without
+// knowing.  A released or expired lease keeps its last token.
+type Lease struct {
+	Name     string    `json:"name"`
+	Owner    string    `json:"owner,omitempty"`
+	Token    uint64    `json:"token"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// held reports whether the lease is held by anyone at now.
+func (l *Lease) held(now time.Time) bool {
+	return len(l.Owner) != 0 && l.Expires.After(now)
+}
+
+// LeaseEndpoint shows a lease on GET and changes it on POST:
+//
+//	?acquire[&ttl=30s]        take the lease if nobody holds it
+//	?renew&token=n[&ttl=30s]  extend a lease still held with token n
+//	?release&token=n          give up a lease held with token n
+//
+// Only the subject holding a lease may renew or release it, though admins
+// may release any lease.  Lease state is kept on disk, so a restart does
+// not free held leases or reuse tokens.
+//
+// Changes are made under the lease's key lock, which holds across every
+// server sharing BaseDirectory once Start has opened the key lock file, so
+// no two servers can hand out the same token.  Leases are refused until
+// then.  Where fcntl locks are not available the lock only holds within
+// one server, and leases need a single server.
+func (s Server) LeaseEndpoint(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, LeasePrefix)
+	if len(name) == 0 || len(name) > maxLeaseName {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		lease, err := s.readLease(name)
+		if err != nil {
+			respond.WithStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+		if lease.Token == 0 {
+			respond.WithStatus(w, r, http.StatusNotFound)
+			return
+		}
+		respond.With(w, r, http.StatusOK, lease)
+		return
+	}
+
+	owner := identity.Subject(r)
+	if len(owner) == 0 {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	ttl := DefaultLeaseTTL
+	if len(query.Get("ttl")) != 0 {
+		var err error
+		ttl, err = time.ParseDuration(query.Get("ttl"))
+		if err != nil || ttl <= 0 || ttl > MaxLeaseTTL {
+			respond.WithStatus(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	token, _ := strconv.ParseUint(query.Get("token"), 10, 64)
+
+	if s.keyLockFile() == nil {
+		respond.WithStatus(w, r, http.StatusServiceUnavailable)
+		return
+	}
+	unlock := s.lockKey(leaseDirName + "/" + name)
+	defer unlock()
+
+	lease, err := s.readLease(name)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case hasParam(query, "acquire"):
+		if lease.held(now) {
+			respond.With(w, r, http.StatusConflict, lease)
+			return
+		}
+		lease.Owner = owner
+		lease.Token++
+		lease.Acquired = now
+		lease.Expires = now.Add(ttl)
+	case hasParam(query, "renew"):
+		if !lease.held(now) || lease.Owner != owner || lease.Token != token {
+			respond.With(w, r, http.StatusConflict, lease)
+			return
+		}
+		lease.Expires = now.Add(ttl)
+	case hasParam(query, "release"):
+		if !lease.held(now) || lease.Token != token {
+			respond.With(w, r, http.StatusConflict, lease)
+			return
+		}
+		if lease.Owner != owner && !s.isAdmin(r) {
+			respond.WithStatus(w, r, http.StatusForbidden)
+			return
+		}
+		lease.Owner = ""
+		lease.Expires = now
+	default:
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err = s.writeLease(lease)
+	if err != nil {
+		s.respondWriteError(w, r, err)
+		return
+	}
+	respond.With(w, r, http.StatusOK, lease)
+}
+
+func (s Server) leaseDir() string {
+	return path.Join(s.BaseDirectory, leaseDirName)
+}
+
+// leasePath is where the lease called name is kept.  Names are hashed like
+// keys so any name makes a safe file name.
+func (s Server) leasePath(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return path.Join(s.leaseDir(), hex.EncodeToString(sum[:]))
+}
+
+// readLease loads the lease called name, which is empty if it has never
+// been acquired.
+func (s Server) readLease(name string) (*Lease, error) {
+	lease := &Lease{Name: name}
+	data, err := ioutil.ReadFile(s.leasePath(name))
+	if os.IsNotExist(err) {
+		return lease, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, lease)
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// writeLease saves lease durably, since a fencing token that went back
+// after a crash could be handed out twice.
+func (s Server) writeLease(lease *Lease) error {
+	_, err := os.Stat(s.leaseDir())
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(s.leaseDir(), 0777)
+		if err == nil {
+			err = syncDir(s.BaseDirectory)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return writeDurable(s.leasePath(lease.Name), data)
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fshandler
+
+import "os"
+
+// linkCountSupported reports whether linkCount can be trusted, which the
+// deduplicated blob store relies on for reference counting.
+const linkCountSupported = false
+
+// linkCount can not be determined on this platform, so every file looks
+// singly linked.
+func linkCount(fi os.FileInfo) uint64 {
+	return 1
+}
+
+// fileID can not tell which files share an inode on this platform.
+func fileID(fi os.FileInfo) (interface{}, bool) {
+	return nil, false
+}
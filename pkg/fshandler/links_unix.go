@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package fshandler
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCountSupported reports whether linkCount can be trusted, which the
+// deduplicated blob store relies on for reference counting.
+const linkCountSupported = true
+
+// linkCount returns the number of hard links to the file behind fi.
+func linkCount(fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+	return uint64(st.Nlink)
+}
+
+// fileID identifies the inode behind fi, so files linked to it more than
+// once are counted once.
+func fileID(fi os.FileInfo) (interface{}, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, true
+}
@@ -0,0 +1,195 @@
+package fshandler
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// metaSuffix is appended to an object's path to find its metadata.
+const metaSuffix = ".meta"
+
+// objectMeta is stored as JSON next to every object written by PutEndpoint.
+// Objects written before metadata existed have none and are treated as
+// plain, uncompressed bytes.
+type objectMeta struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	Digest      string    `json:"digest"`
+	ContentType string    `json:"content_type,omitempty"`
+	Encoding    string    `json:"encoding,omitempty"`
+	StoredSize  int64     `json:"stored_size"`
+	Created     time.Time `json:"created"`
+
+	Encryption *encryptionMeta `json:"encryption,omitempty"`
+
+	Retention *retentionMeta `json:"retention,omitempty"`
+	LegalHold bool           `json:"legal_hold,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Appendable objects grow with POST ?append until they are sealed.
+	Appendable bool `json:"appendable,omitempty"`
+	Sealed     bool `json:"sealed,omitempty"`
+}
+
+// encodedSize is the size of the object in its stored content encoding,
+// once any encryption has been removed.
+func (m *objectMeta) encodedSize() int64 {
+	if m.Encryption != nil {
+		return m.Encryption.PlainSize
+	}
+	return m.StoredSize
+}
+
+// etag returns the entity tag for the object as stored with encoding, or
+// for the decoded bytes if encoding is empty.
+func (m *objectMeta) etag(encoding string) string {
+	if len(m.Digest) == 0 {
+		return ""
+	}
+	if len(encoding) == 0 {
+		return `"` + m.Digest + `"`
+	}
+	return `"` + m.Digest + "-" + encoding + `"`
+}
+
+func metaPath(filepath string) string {
+	return filepath + metaSuffix
+}
+
+// readMeta loads the metadata for the object at filepath.  A nil meta and
+// nil error means the object has no metadata.
+func (s Server) readMeta(ctx context.Context, filepath string) (*objectMeta, error) {
+	defer s.timed(ctx, "read_meta")()
+
+	data, err := ioutil.ReadFile(metaPath(filepath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &objectMeta{}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeMeta atomically replaces the metadata for the object at filepath.
+func (s Server) writeMeta(ctx context.Context, filepath string, meta *objectMeta) error {
+	defer s.timed(ctx, "write_meta")()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(metaPath(filepath), data)
+}
+
+// placeObject creates the object at filepath from meta and the data put
+// there by place, such as a link to a staged file.  Metadata goes first so
+// nobody ever sees the data without it, and goes again if the data cannot
+// be placed.  Objects from before metadata was kept have none to write.
+// An error satisfying os.IsExist, with nothing changed, is returned if
+// filepath is already taken.  The caller holds the key's lock.
+func (s Server) placeObject(ctx context.Context, filepath string, meta *objectMeta, place func() error) error {
+	err := os.MkdirAll(path.Dir(filepath), 0777)
+	if err != nil {
+		return err
+	}
+	if checkFile(filepath) == nil {
+		return &os.PathError{Op: "place", Path: filepath, Err: os.ErrExist}
+	}
+
+	if meta != nil {
+		err = s.writeMeta(ctx, filepath, meta)
+		if err != nil {
+			return err
+		}
+	}
+	err = place()
+	if err != nil && meta != nil {
+		os.Remove(metaPath(filepath))
+	}
+	return err
+}
+
+// writeAtomic replaces the file at name with data, so readers see either
+// the old contents or the new, never a mix.
+func writeAtomic(name string, data []byte) error {
+	return replaceFile(name, data, false)
+}
+
+// writeDurable is writeAtomic for files that must not be lost or roll back
+// in a crash once written.  The data is synced before the rename, and the
+// directory after it.
+func writeDurable(name string, data []byte) error {
+	return replaceFile(name, data, true)
+}
+
+func replaceFile(name string, data []byte, durable bool) error {
+	file, err := ioutil.TempFile(path.Dir(name), ".meta-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && durable {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	err = os.Rename(file.Name(), name)
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if durable {
+		return syncDir(path.Dir(name))
+	}
+	return nil
+}
+
+// syncDir makes the entries in dir, such as a file just renamed into it,
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// statMeta returns the metadata for the object at filepath, synthesising it
+// from the file itself when none was stored.
+func (s Server) statMeta(ctx context.Context, filepath string) (*objectMeta, error) {
+	meta, err := s.readMeta(ctx, filepath)
+	if err != nil || meta != nil {
+		return meta, err
+	}
+
+	info, err := os.Stat(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return &objectMeta{
+		Size:       info.Size(),
+		StoredSize: info.Size(),
+		Created:    info.ModTime(),
+	}, nil
+}
@@ -0,0 +1,114 @@
+package fshandler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/drhayt/coatlocker/pkg/identity"
+	"github.com/drhayt/coatlocker/pkg/metrics"
+	"github.com/drhayt/coatlocker/pkg/trace"
+)
+
+// backendMetric times the filesystem work behind requests, by operation.
+const backendMetric = "coatlocker_backend_operation_duration_seconds"
+
+// AuthFailureMetric counts refused requests by reason. The JWT middleware
+// counts bad tokens under it and the handlers count refused admins.
+const (
+	AuthFailureMetric = "coatlocker_auth_failures_total"
+	AuthFailureHelp   = "Requests refused for want of a valid token, or for not being an admin."
+)
+
+// storageMetrics are the last storage totals counted, and when.
+type storageMetrics struct {
+	mu      sync.RWMutex
+	stats   BlobStats
+	counted time.Time
+}
+
+// storageCount is what StatsEndpoint last counted, for the storage
+// metrics.
+var storageCount storageMetrics
+
+func (m *storageMetrics) set(stats BlobStats) {
+	m.mu.Lock()
+	m.stats = stats
+	m.counted = time.Now()
+	m.mu.Unlock()
+}
+
+func (m *storageMetrics) get(field func(BlobStats) int64) func() float64 {
+	return func() float64 {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return float64(field(m.stats))
+	}
+}
+
+// startMetrics registers the storage and certificate metrics.  The storage
+// totals are those an admin last asked StatsEndpoint for, since counting
+// them walks every object.
+func (s Server) startMetrics() {
+	storage := &storageCount
+	s.Metrics.GaugeFunc("coatlocker_storage_objects", "Objects stored, as last counted.", storage.get(func(stats BlobStats) int64 {
+		return stats.Objects
+	}))
+	s.Metrics.GaugeFunc("coatlocker_storage_logical_bytes", "Bytes of objects as uploaded, as last counted.", storage.get(func(stats BlobStats) int64 {
+		return stats.LogicalBytes
+	}))
+	s.Metrics.GaugeFunc("coatlocker_storage_physical_bytes", "Bytes used on disk by objects and blobs, as last counted.", storage.get(func(stats BlobStats) int64 {
+		return stats.PhysicalBytes
+	}))
+	s.Metrics.GaugeFunc("coatlocker_storage_counted_timestamp_seconds", "When the storage totals were last counted, in seconds since the epoch, or 0 if they have not been.", func() float64 {
+		storage.mu.RLock()
+		defer storage.mu.RUnlock()
+		if storage.counted.IsZero() {
+			return 0
+		}
+		return float64(storage.counted.Unix())
+	})
+	if s.Space != nil {
+		s.Metrics.GaugeFunc("coatlocker_storage_free_bytes", "Bytes free on the filesystem holding the objects.", func() float64 {
+			return float64(s.Space.Status().FreeBytes)
+		})
+	}
+	if s.Certificate != nil {
+		s.Metrics.GaugeFunc("coatlocker_tls_certificate_expiry_timestamp_seconds", "When the TLS certificate being served expires, in seconds since the epoch.", func() float64 {
+			return float64(s.Certificate.NotAfter().Unix())
+		})
+	}
+}
+
+// isAdmin reports whether r was made by an admin, counting it as an auth
+// failure when it was not.
+func (s Server) isAdmin(r *http.Request) bool {
+	if identity.IsAdmin(r, s.Settings.Load().Admins) {
+		return true
+	}
+	s.Metrics.Counter(AuthFailureMetric, AuthFailureHelp, "reason").Inc("not_admin")
+	return false
+}
+
+// timed starts timing a backend operation, as a metric and as a span of
+// the trace in ctx, returning the function that records it.
+func (s Server) timed(ctx context.Context, operation string) func() {
+	_, done := s.operation(ctx, operation)
+	return done
+}
+
+// operation is timed for operations that also note attributes, such as the
+// bytes they moved, on their span.
+func (s Server) operation(ctx context.Context, operation string) (*trace.Span, func()) {
+	_, span := trace.Start(ctx, "storage."+operation)
+	if s.Metrics == nil && span == nil {
+		return nil, func() {}
+	}
+	start := time.Now()
+	return span, func() {
+		s.Metrics.Histogram(backendMetric, "Time taken by filesystem operations.", metrics.DefaultBuckets, "operation").
+			Observe(time.Since(start).Seconds(), operation)
+		span.End()
+	}
+}
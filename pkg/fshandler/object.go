@@ -0,0 +1,216 @@
+package fshandler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/drhayt/coatlocker/pkg/trace"
+)
+
+// objectReader is a seekable view of a stored object along with everything
+// that has to be closed once it has been read.  Reading it is timed as the
+// read operation, which ends on Close with the number of bytes read.
+type objectReader struct {
+	io.ReadSeeker
+	closers []io.Closer
+
+	read int64
+	span *trace.Span
+	done func()
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	n, err := o.ReadSeeker.Read(p)
+	o.read += int64(n)
+	return n, err
+}
+
+// Close releases the reader's resources, innermost last.
+func (o *objectReader) Close() error {
+	for i := len(o.closers) - 1; i >= 0; i-- {
+		o.closers[i].Close()
+	}
+	if o.done != nil {
+		o.span.SetAttribute("storage.bytes", o.read)
+		o.done()
+		o.done = nil
+	}
+	return nil
+}
+
+// openEncoded opens the object at filepath and undoes any encryption,
+// leaving it in its stored content encoding.  customerKey is only needed for
+// objects stored with a customer provided key.
+func (s Server) openEncoded(ctx context.Context, filepath string, meta *objectMeta, customerKey []byte) (*objectReader, error) {
+	defer s.timed(ctx, "open")()
+
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	reader := &objectReader{ReadSeeker: file, closers: []io.Closer{file}}
+
+	// An append may be under way past the end the metadata knows about.
+	if meta.Appendable {
+		reader.ReadSeeker = io.NewSectionReader(file, 0, meta.StoredSize)
+	}
+
+	if meta.Encryption != nil {
+		dataKey, err := s.dataKey(meta.Encryption, customerKey)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		decrypter, err := newDecryptingReader(file, dataKey, meta.Encryption)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		reader.ReadSeeker = decrypter
+	}
+	reader.span, reader.done = s.operation(ctx, "read")
+	return reader, nil
+}
+
+// openDecoded opens the object at filepath as the bytes originally uploaded.
+func (s Server) openDecoded(ctx context.Context, filepath string, meta *objectMeta, customerKey []byte) (*objectReader, error) {
+	reader, err := s.openEncoded(ctx, filepath, meta, customerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(meta.Encoding) != 0 {
+		decoder := newDecodingReader(reader.ReadSeeker, meta.Encoding, meta.Size)
+		reader.ReadSeeker = decoder
+		reader.closers = append(reader.closers, decoder)
+	}
+	return reader, nil
+}
+
+// dataKey recovers the data key an object was encrypted with.
+func (s Server) dataKey(enc *encryptionMeta, customerKey []byte) ([]byte, error) {
+	if len(enc.CustomerKeySHA256) != 0 {
+		if !checkCustomerKey(enc, customerKey) {
+			return nil, fmt.Errorf("object is encrypted with a different customer key")
+		}
+		return unwrapWithCustomerKey(customerKey, enc.WrappedKey)
+	}
+	if s.Encryption == nil {
+		return nil, fmt.Errorf("object is encrypted but no key provider is configured")
+	}
+	return s.Encryption.UnwrapKey(enc.KeyID, enc.WrappedKey)
+}
+
+// encrypt seals the staged file src under a new data key, returning the new
+// file's path and size.  The data key is wrapped by customerKey if one was
+// supplied, otherwise by the server's KeyProvider.  The caller owns the new
+// file.
+func (s Server) encrypt(ctx context.Context, src string, meta *objectMeta, customerKey []byte) (string, int64, error) {
+	dataKey, err := newDataKey()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var keyID, fingerprint string
+	var wrapped []byte
+	if customerKey != nil {
+		keyID = customerKeyID
+		fingerprint = customerKeyFingerprint(customerKey)
+		wrapped, err = wrapWithCustomerKey(customerKey, dataKey)
+	} else {
+		keyID, wrapped, err = s.Encryption.WrapKey(dataKey)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	done := s.timed(ctx, "encrypt")
+	encrypted, size, err := encryptFile(src, dataKey)
+	done()
+	if err != nil {
+		return "", 0, err
+	}
+
+	meta.Encryption = &encryptionMeta{
+		Scheme:     encryptionScheme,
+		ChunkSize:  encryptChunkSize,
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		PlainSize:  meta.StoredSize,
+
+		CustomerKeySHA256: fingerprint,
+	}
+	return encrypted, size, nil
+}
+
+// RotateKeys re-wraps the data key of every object not already wrapped by
+// the current master key.  Only metadata is rewritten; object data is left
+// untouched.  It returns how many objects were updated.
+//
+// Each object is rewritten under its key lock, so rotation can run beside
+// the servers as long as they already hold the new master key.
+func (s Server) RotateKeys() (int, error) {
+	if s.Encryption == nil {
+		return 0, fmt.Errorf("no key provider is configured")
+	}
+	err := s.openKeyLocks()
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	err = s.walkObjects(func(filepath string, info os.FileInfo) error {
+		ok, err := s.rotateKey(filepath, info.Name())
+		if err != nil {
+			return fmt.Errorf("%s: %s", filepath, err)
+		}
+		if ok {
+			rotated++
+		}
+		return nil
+	})
+	return rotated, err
+}
+
+// rotateKey re-wraps the data key of the object at filepath, named name,
+// reporting whether it needed to.
+func (s Server) rotateKey(filepath, name string) (bool, error) {
+	unlock := s.lockKey(name)
+	defer unlock()
+
+	// The object may have been deleted or replaced since it was walked.
+	if checkFile(filepath) != nil {
+		return false, nil
+	}
+	ctx := context.Background()
+	meta, err := s.readMeta(ctx, filepath)
+	if err != nil {
+		return false, err
+	}
+	if meta == nil || meta.Encryption == nil || meta.Encryption.KeyID == s.Encryption.CurrentKeyID() {
+		return false, nil
+	}
+	// Customer keyed objects were never wrapped by the provider.
+	if len(meta.Encryption.CustomerKeySHA256) != 0 {
+		return false, nil
+	}
+
+	dataKey, err := s.dataKey(meta.Encryption, nil)
+	if err != nil {
+		return false, err
+	}
+	keyID, wrapped, err := s.Encryption.WrapKey(dataKey)
+	if err != nil {
+		return false, err
+	}
+	meta.Encryption.KeyID = keyID
+	meta.Encryption.WrappedKey = wrapped
+
+	err = s.writeMeta(ctx, filepath, meta)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,279 @@
+package fshandler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// probeTimeout bounds each check, so a hung filesystem fails the probe
+// rather than hanging it.
+const probeTimeout = 5 * time.Second
+
+// The heartbeat beats every heartbeatInterval, and liveness fails once it
+// has been quiet for heartbeatTimeout.
+const (
+	heartbeatInterval = time.Second
+	heartbeatTimeout  = 10 * time.Second
+)
+
+var (
+	heartbeatOnce sync.Once
+	// lastBeat is when the heartbeat last beat, in nanoseconds since the
+	// epoch.  It is only touched atomically.
+	lastBeat int64
+)
+
+// Check results.
+const (
+	checkOK       = "ok"
+	checkDegraded = "degraded"
+	checkFailed   = "failed"
+	checkSkipped  = "skipped"
+)
+
+// CheckResult is the outcome of one check.  A degraded check is worth
+// knowing about but does not fail the probe.
+type CheckResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// ProbeResponse breaks a probe down by check.
+type ProbeResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// check is a named check, returning one of the check results and the
+// error behind it.
+type check struct {
+	name string
+	run  func() (string, error)
+}
+
+// LivenessEndpoint reports whether the process is working at all: that
+// its heartbeat goroutine is still being scheduled.  It looks at neither
+// storage nor the key locks, so a full disk or a long append never gets a
+// healthy process restarted.
+func (s Server) LivenessEndpoint(w http.ResponseWriter, r *http.Request) {
+	runProbe(w, r, []check{
+		{"heartbeat", checkHeartbeat},
+	})
+}
+
+// startHeartbeat starts the heartbeat, once.
+func startHeartbeat() {
+	heartbeatOnce.Do(func() {
+		atomic.StoreInt64(&lastBeat, time.Now().UnixNano())
+		go func() {
+			for range time.Tick(heartbeatInterval) {
+				atomic.StoreInt64(&lastBeat, time.Now().UnixNano())
+			}
+		}()
+	})
+}
+
+// ReadinessEndpoint reports whether the server can serve requests: that
+// it is not shutting down, storage can be written, read and deleted, the
+// JWT and TLS certificates are in date and there is room for uploads.
+func (s Server) ReadinessEndpoint(w http.ResponseWriter, r *http.Request) {
+	runProbe(w, r, []check{
+		{"shutdown", s.checkDrain},
+		{"storage", s.checkStorage},
+		{"jwt", s.checkJWTCertificate},
+		{"tls", s.checkTLSCertificate},
+		{"disk", s.checkDisk},
+	})
+}
+
+// runProbe runs checks and answers 200 if none failed, or 503.
+func runProbe(w http.ResponseWriter, r *http.Request, checks []check) {
+	response := ProbeResponse{Status: checkOK, Checks: map[string]CheckResult{}}
+	for _, c := range checks {
+		result := runCheck(c)
+		if result.Status == checkFailed {
+			response.Status = checkFailed
+		}
+		response.Checks[c.name] = result
+	}
+
+	status := http.StatusOK
+	if response.Status == checkFailed {
+		status = http.StatusServiceUnavailable
+	}
+	respond.With(w, r, status, response)
+}
+
+func runCheck(c check) CheckResult {
+	type outcome struct {
+		status string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	start := time.Now()
+	go func() {
+		status, err := c.run()
+		done <- outcome{status, err}
+	}()
+
+	result := CheckResult{}
+	select {
+	case o := <-done:
+		result.Status = o.status
+		if o.err != nil {
+			result.Error = o.err.Error()
+		}
+	case <-time.After(probeTimeout):
+		result.Status = checkFailed
+		result.Error = fmt.Sprintf("no answer after %s", probeTimeout)
+	}
+	result.DurationMS = float64(time.Since(start)) / float64(time.Millisecond)
+	return result
+}
+
+// checkDrain fails once the server has begun shutting down.
+func (s Server) checkDrain() (string, error) {
+	if s.Drain.Draining() {
+		return checkFailed, fmt.Errorf("shutting down")
+	}
+	return checkOK, nil
+}
+
+// checkHeartbeat fails once the heartbeat has gone quiet.  It is skipped
+// until the server has started.
+func checkHeartbeat() (string, error) {
+	last := atomic.LoadInt64(&lastBeat)
+	if last == 0 {
+		return checkSkipped, nil
+	}
+	quiet := time.Since(time.Unix(0, last))
+	if quiet > heartbeatTimeout {
+		return checkFailed, fmt.Errorf("no heartbeat for %s", quiet.Round(time.Second))
+	}
+	return checkOK, nil
+}
+
+// checkStorage writes a probe file where uploads are staged, reads it back
+// and deletes it.  BaseDirectory itself is never created, so a missing
+// mount shows up.
+func (s Server) checkStorage() (string, error) {
+	err := os.Mkdir(s.tmpDir(), 0777)
+	if err != nil && !os.IsExist(err) {
+		return checkFailed, err
+	}
+
+	want := make([]byte, 64)
+	_, err = io.ReadFull(rand.Reader, want)
+	if err != nil {
+		return checkFailed, err
+	}
+
+	file, err := ioutil.TempFile(s.tmpDir(), stagedPrefix("probe"))
+	if err != nil {
+		return checkFailed, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(want)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return checkFailed, err
+	}
+
+	got, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return checkFailed, err
+	}
+	if !bytes.Equal(got, want) {
+		return checkFailed, fmt.Errorf("probe file read back differently")
+	}
+	err = os.Remove(file.Name())
+	if err != nil {
+		return checkFailed, err
+	}
+	return checkOK, nil
+}
+
+// checkJWTCertificate checks the certificate tokens are validated against
+// can be loaded and is in date.
+func (s Server) checkJWTCertificate() (string, error) {
+	if len(s.JWTCertFile) == 0 {
+		return checkFailed, fmt.Errorf("no JWT certificate is configured")
+	}
+	data, err := ioutil.ReadFile(s.JWTCertFile)
+	if err != nil {
+		return checkFailed, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return checkFailed, fmt.Errorf("%s holds no PEM encoded certificate", s.JWTCertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return checkFailed, err
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return checkFailed, fmt.Errorf("JWT certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return checkFailed, fmt.Errorf("JWT certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return checkOK, nil
+}
+
+// checkTLSCertificate fails once the certificate being served has expired,
+// and reports degraded when it is due for renewal.
+func (s Server) checkTLSCertificate() (string, error) {
+	if s.Certificate == nil {
+		return checkSkipped, nil
+	}
+	notAfter := s.Certificate.NotAfter()
+	left := time.Until(notAfter)
+	if left <= 0 {
+		return checkFailed, fmt.Errorf("TLS certificate expired at %s", notAfter.Format(time.RFC3339))
+	}
+	if left < CertificateRenewalWindow {
+		return checkDegraded, fmt.Errorf("TLS certificate expires at %s", notAfter.Format(time.RFC3339))
+	}
+	return checkOK, nil
+}
+
+// checkDisk fails once uploads are being refused for want of space, and
+// reports degraded below the low watermark.
+func (s Server) checkDisk() (string, error) {
+	if s.Space == nil {
+		return checkSkipped, nil
+	}
+	status := s.Space.Status()
+	if len(status.Error) != 0 {
+		return checkFailed, errors.New(status.Error)
+	}
+	if status.ReadOnly {
+		return checkFailed, fmt.Errorf("%d bytes free, below the critical watermark", status.FreeBytes)
+	}
+	if status.Degraded {
+		return checkDegraded, fmt.Errorf("%d bytes free, below the low watermark", status.FreeBytes)
+	}
+	return checkOK, nil
+}
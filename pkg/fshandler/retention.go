@@ -0,0 +1,180 @@
+package fshandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/drhayt/coatlocker/pkg/identity"
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// Headers used to lock objects against deletion.  Retention is set with a
+// mode and a date on PUT, or later with POST ?retention.  The same headers
+// are returned on GET and HEAD.
+const (
+	RetentionModeHeader    = "X-Coatlocker-Retention-Mode"
+	RetainUntilHeader      = "X-Coatlocker-Retain-Until"
+	LegalHoldHeader        = "X-Coatlocker-Legal-Hold"
+	BypassGovernanceHeader = "X-Coatlocker-Bypass-Governance"
+)
+
+// Retention modes.  Governance retention can be shortened, removed or
+// bypassed by an admin; compliance retention can only ever be extended.
+const (
+	RetentionGovernance = "GOVERNANCE"
+	RetentionCompliance = "COMPLIANCE"
+)
+
+// retentionMeta records how long an object is locked for.
+type retentionMeta struct {
+	Mode        string    `json:"mode"`
+	RetainUntil time.Time `json:"retain_until"`
+}
+
+// retentionFromHeaders reads the retention requested by r, or nil if none.
+func retentionFromHeaders(r *http.Request) (*retentionMeta, error) {
+	mode := strings.ToUpper(r.Header.Get(RetentionModeHeader))
+	until := r.Header.Get(RetainUntilHeader)
+	if len(mode) == 0 && len(until) == 0 {
+		return nil, nil
+	}
+
+	if mode != RetentionGovernance && mode != RetentionCompliance {
+		return nil, fmt.Errorf("retention mode must be %s or %s", RetentionGovernance, RetentionCompliance)
+	}
+	retainUntil, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return nil, fmt.Errorf("retain until must be an RFC 3339 time: %s", err)
+	}
+	if !retainUntil.After(time.Now()) {
+		return nil, fmt.Errorf("retain until must be in the future")
+	}
+	return &retentionMeta{Mode: mode, RetainUntil: retainUntil.UTC()}, nil
+}
+
+// locked reports whether meta forbids deleting or changing the object.  An
+// admin asking to bypass governance retention gets past it, but never past
+// compliance retention or a legal hold.
+func (s Server) locked(meta *objectMeta, r *http.Request) bool {
+	if meta == nil {
+		return false
+	}
+	if meta.LegalHold {
+		return true
+	}
+	if meta.Retention == nil || !meta.Retention.RetainUntil.After(time.Now()) {
+		return false
+	}
+	if meta.Retention.Mode == RetentionGovernance && s.bypassGovernance(r) {
+		return false
+	}
+	return true
+}
+
+func (s Server) bypassGovernance(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(BypassGovernanceHeader), "true") && identity.IsAdmin(r, s.Settings.Load().Admins)
+}
+
+// setRetentionHeaders describes the object's lock on a response.
+func setRetentionHeaders(w http.ResponseWriter, meta *objectMeta) {
+	if meta.Retention != nil {
+		w.Header().Set(RetentionModeHeader, meta.Retention.Mode)
+		w.Header().Set(RetainUntilHeader, meta.Retention.RetainUntil.Format(time.RFC3339))
+	}
+	if meta.LegalHold {
+		w.Header().Set(LegalHoldHeader, "ON")
+	}
+}
+
+// allowedRetentionChange reports whether the retention on an object may go
+// from current to next.
+func (s Server) allowedRetentionChange(current, next *retentionMeta, r *http.Request) bool {
+	if current == nil || !current.RetainUntil.After(time.Now()) {
+		return true
+	}
+
+	extends := next != nil && !next.RetainUntil.Before(current.RetainUntil)
+	switch current.Mode {
+	case RetentionCompliance:
+		return extends && next.Mode == RetentionCompliance
+	default:
+		return extends || s.bypassGovernance(r)
+	}
+}
+
+// setRetention handles POST ?retention, replacing the object's retention
+// with the one in the request headers.  Sending no retention headers
+// removes governance retention, given the right to bypass it.
+func (s Server) setRetention(w http.ResponseWriter, r *http.Request, key string) {
+	retention, err := retentionFromHeaders(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	s.updateMeta(w, r, key, func(meta *objectMeta) int {
+		if !s.allowedRetentionChange(meta.Retention, retention, r) {
+			return http.StatusForbidden
+		}
+		meta.Retention = retention
+		return http.StatusOK
+	})
+}
+
+// setLegalHold handles POST ?legal-hold=on|off, which only admins may use.
+func (s Server) setLegalHold(w http.ResponseWriter, r *http.Request, key, value string) {
+	if !s.isAdmin(r) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+
+	var hold bool
+	switch strings.ToLower(value) {
+	case "on":
+		hold = true
+	case "off":
+		hold = false
+	default:
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	s.updateMeta(w, r, key, func(meta *objectMeta) int {
+		meta.LegalHold = hold
+		return http.StatusOK
+	})
+}
+
+// updateMeta applies change to the metadata of the object for key under its
+// lock, writing it back if change returns 200.
+func (s Server) updateMeta(w http.ResponseWriter, r *http.Request, key string, change func(meta *objectMeta) int) {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	filepath := s.findPath(key)
+	if checkFile(filepath) != nil {
+		respond.WithStatus(w, r, http.StatusNotFound)
+		return
+	}
+
+	meta, err := s.statMeta(r.Context(), filepath)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	status := change(meta)
+	if status != http.StatusOK {
+		respond.WithStatus(w, r, status)
+		return
+	}
+
+	err = s.writeMeta(r.Context(), filepath, meta)
+	if err != nil {
+		s.respondWriteError(w, r, err)
+		return
+	}
+	respond.WithStatus(w, r, http.StatusOK)
+}
@@ -0,0 +1,119 @@
+package fshandler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/drhayt/coatlocker/pkg/identity"
+)
+
+// asSubject returns r as made by subject, as the JWT middleware leaves it.
+func asSubject(r *http.Request, subject string) *http.Request {
+	token := &jwt.Token{Claims: jwt.MapClaims{"sub": subject}}
+	return r.WithContext(context.WithValue(r.Context(), identity.UserProperty, token))
+}
+
+// bypassing returns a request from an admin asking to bypass governance
+// retention.
+func bypassing() *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/a?retention", nil)
+	r.Header.Set(BypassGovernanceHeader, "true")
+	return asSubject(r, "root")
+}
+
+func TestAllowedRetentionChange(t *testing.T) {
+	s := Server{Settings: NewLiveSettings(Settings{Admins: []string{"root"}})}
+	now := time.Now()
+	later, sooner := now.Add(48*time.Hour), now.Add(time.Hour)
+	current := now.Add(24 * time.Hour)
+	plain := httptest.NewRequest(http.MethodPost, "/a?retention", nil)
+
+	for _, test := range []struct {
+		name    string
+		current *retentionMeta
+		next    *retentionMeta
+		r       *http.Request
+		allowed bool
+	}{
+		{"compliance extended", &retentionMeta{RetentionCompliance, current}, &retentionMeta{RetentionCompliance, later}, plain, true},
+		{"compliance kept", &retentionMeta{RetentionCompliance, current}, &retentionMeta{RetentionCompliance, current}, plain, true},
+		{"compliance shortened", &retentionMeta{RetentionCompliance, current}, &retentionMeta{RetentionCompliance, sooner}, plain, false},
+		{"compliance shortened by admin", &retentionMeta{RetentionCompliance, current}, &retentionMeta{RetentionCompliance, sooner}, bypassing(), false},
+		{"compliance removed", &retentionMeta{RetentionCompliance, current}, nil, plain, false},
+		{"compliance removed by admin", &retentionMeta{RetentionCompliance, current}, nil, bypassing(), false},
+		{"compliance weakened to governance", &retentionMeta{RetentionCompliance, current}, &retentionMeta{RetentionGovernance, later}, plain, false},
+		{"compliance expired", &retentionMeta{RetentionCompliance, now.Add(-time.Hour)}, nil, plain, true},
+		{"governance extended", &retentionMeta{RetentionGovernance, current}, &retentionMeta{RetentionGovernance, later}, plain, true},
+		{"governance strengthened", &retentionMeta{RetentionGovernance, current}, &retentionMeta{RetentionCompliance, later}, plain, true},
+		{"governance shortened", &retentionMeta{RetentionGovernance, current}, &retentionMeta{RetentionGovernance, sooner}, plain, false},
+		{"governance shortened by admin", &retentionMeta{RetentionGovernance, current}, &retentionMeta{RetentionGovernance, sooner}, bypassing(), true},
+		{"governance removed by non-admin", &retentionMeta{RetentionGovernance, current}, nil, asSubject(bypassing(), "someone"), false},
+		{"none set", nil, &retentionMeta{RetentionCompliance, sooner}, plain, true},
+	} {
+		allowed := s.allowedRetentionChange(test.current, test.next, test.r)
+		if allowed != test.allowed {
+			t.Errorf("%s: allowed = %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func TestComplianceRetentionRefusesShortening(t *testing.T) {
+	s := Server{
+		BaseDirectory: t.TempDir(),
+		Settings:      NewLiveSettings(Settings{Admins: []string{"root"}}),
+	}
+	until := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	key := s.genKey("/a")
+	meta := &objectMeta{
+		Key:       "/a",
+		Created:   time.Now().UTC(),
+		Retention: &retentionMeta{Mode: RetentionCompliance, RetainUntil: until},
+	}
+	status := s.storeObject(context.Background(), strings.NewReader("kept"), key, meta, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("storing the object answered %d", status)
+	}
+
+	for name, r := range map[string]*http.Request{
+		"shortening":          retentionRequest(RetentionCompliance, until.Add(-time.Hour)),
+		"shortening as admin": asSubject(retentionRequest(RetentionCompliance, until.Add(-time.Hour)), "root"),
+		"weakening":           retentionRequest(RetentionGovernance, until.Add(time.Hour)),
+		"removing as admin":   bypassing(),
+	} {
+		w := httptest.NewRecorder()
+		s.setRetention(w, r, key)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: answered %d, want %d", name, w.Code, http.StatusForbidden)
+		}
+	}
+
+	stored, err := s.readMeta(context.Background(), s.findPath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Retention == nil || stored.Retention.Mode != RetentionCompliance || !stored.Retention.RetainUntil.Equal(until) {
+		t.Errorf("retention became %+v", stored.Retention)
+	}
+	if !s.locked(stored, bypassing()) {
+		t.Error("an admin bypassing governance got past compliance retention")
+	}
+
+	w := httptest.NewRecorder()
+	s.setRetention(w, retentionRequest(RetentionCompliance, until.Add(time.Hour)), key)
+	if w.Code != http.StatusOK {
+		t.Errorf("extending answered %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// retentionRequest asks for retention in mode until the given time.
+func retentionRequest(mode string, until time.Time) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/a?retention", nil)
+	r.Header.Set(RetentionModeHeader, mode)
+	r.Header.Set(RetainUntilHeader, until.Format(time.RFC3339))
+	return r
+}
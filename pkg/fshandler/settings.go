@@ -0,0 +1,45 @@
+package fshandler
+
+import "sync/atomic"
+
+// Settings are the parts of a server's configuration that can be changed
+// while it runs.
+type Settings struct {
+	// Admins are the JWT subjects allowed to use admin endpoints.
+	Admins []string
+
+	// MaxEntrySize is the largest file PUT ?extract stores from an archive,
+	// DefaultMaxEntrySize if unset.
+	MaxEntrySize int64
+
+	// Compression, when set, compresses matching objects at rest.
+	Compression *CompressionPolicy
+}
+
+// LiveSettings holds a server's current Settings.  A reload replaces them
+// whole, so a request that loads them once never sees half of a change.
+type LiveSettings struct {
+	v atomic.Value
+}
+
+// NewLiveSettings returns live settings starting out as settings.
+func NewLiveSettings(settings Settings) *LiveSettings {
+	l := &LiveSettings{}
+	l.Store(settings)
+	return l
+}
+
+// Load returns the current settings.  Nil live settings are the zero
+// Settings.
+func (l *LiveSettings) Load() Settings {
+	if l == nil {
+		return Settings{}
+	}
+	settings, _ := l.v.Load().(Settings)
+	return settings
+}
+
+// Store replaces the current settings.
+func (l *LiveSettings) Store(settings Settings) {
+	l.v.Store(settings)
+}
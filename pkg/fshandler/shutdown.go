@@ -0,0 +1,124 @@
+package fshandler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Drain is how a server learns it is shutting down.  Once begun, readiness
+// fails and requests that would otherwise run until the client leaves,
+// watches and follows, finish up so the connections can be drained.
+type Drain struct {
+	once sync.Once
+	done chan struct{}
+}
+
+// NewDrain returns a drain that has not begun.
+func NewDrain() *Drain {
+	return &Drain{done: make(chan struct{})}
+}
+
+// Begin starts draining.  Calling it again does nothing.
+func (d *Drain) Begin() {
+	d.once.Do(func() {
+		close(d.done)
+	})
+}
+
+// Done is closed once draining begins.  A nil drain never begins.
+func (d *Drain) Done() <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.done
+}
+
+// Draining reports whether draining has begun.
+func (d *Drain) Draining() bool {
+	select {
+	case <-d.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// StaleStagedAge is how long a staged file must go untouched before a
+// starting server removes it.  Uploads are written to as they arrive, so
+// anything this old was left by a server that died, not one still running
+// against the same storage.
+const StaleStagedAge = time.Hour
+
+// instanceID tells the files this process stages apart from those of
+// other servers sharing the storage, say during a rolling deploy.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	id := make([]byte, 4)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// stagedPrefix is the prefix of the temporary files this process stages
+// for kind of work.
+func stagedPrefix(kind string) string {
+	return instanceID + "-" + kind + "-"
+}
+
+// Stop cleans up once the server has stopped taking requests, removing
+// uploads it was still staging when it was cut off.  Other servers'
+// uploads are left alone.
+func (s Server) Stop() error {
+	removed, err := s.removeStaged(func(info os.FileInfo) bool {
+		return strings.HasPrefix(info.Name(), instanceID+"-")
+	})
+	if removed > 0 {
+		log.Printf("Removed %d incomplete uploads", removed)
+	}
+	return err
+}
+
+// removeStagedStale removes staged files nobody has touched for
+// StaleStagedAge.
+func (s Server) removeStagedStale() (int, error) {
+	cutoff := time.Now().Add(-StaleStagedAge)
+	return s.removeStaged(func(info os.FileInfo) bool {
+		return info.ModTime().Before(cutoff)
+	})
+}
+
+// removeStaged removes the files in the staging directory that match,
+// returning how many went.
+func (s Server) removeStaged(match func(os.FileInfo) bool) (int, error) {
+	infos, err := ioutil.ReadDir(s.tmpDir())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, info := range infos {
+		if !match(info) {
+			continue
+		}
+		err = os.Remove(path.Join(s.tmpDir(), info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fshandler
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// diskFree is not supported on this platform.
+func diskFree(path string) (free, total uint64, err error) {
+	return 0, 0, fmt.Errorf("free space monitoring is not supported on %s", runtime.GOOS)
+}
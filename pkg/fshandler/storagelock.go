@@ -0,0 +1,51 @@
+package fshandler
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync"
+)
+
+// storageLockName is the file in BaseDirectory that running servers hold a
+// shared lock on, and offline maintenance an exclusive one.
+const storageLockName = ".lock"
+
+// ErrStorageInUse is returned by LockOffline while a server is running
+// against the same BaseDirectory, and by Start while maintenance is.
+var ErrStorageInUse = errors.New("the base directory is in use by a server or by maintenance")
+
+var (
+	// sharedLocks keeps the shared storage locks of running servers open
+	// for as long as the process lives.
+	sharedLocksMu sync.Mutex
+	sharedLocks   []*os.File
+)
+
+// lockShared takes the shared storage lock a running server holds, which
+// any number of servers can hold at once but offline maintenance can not
+// run alongside.
+func (s Server) lockShared() error {
+	lock, err := lockFile(path.Join(s.BaseDirectory, storageLockName), false)
+	if err != nil {
+		return err
+	}
+	sharedLocksMu.Lock()
+	sharedLocks = append(sharedLocks, lock)
+	sharedLocksMu.Unlock()
+	return nil
+}
+
+// LockOffline takes the exclusive storage lock that maintenance which
+// rewrites objects outside the server's key locks needs, returning the
+// function that releases it.  It fails with ErrStorageInUse while any
+// server is running against BaseDirectory.
+func (s Server) LockOffline() (func(), error) {
+	lock, err := lockFile(path.Join(s.BaseDirectory, storageLockName), true)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		lock.Close()
+	}, nil
+}
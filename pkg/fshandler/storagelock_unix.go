@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package fshandler
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes a shared or exclusive flock on name, creating it, without
+// waiting.  The lock lasts until the returned file is closed.
+func lockFile(name string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrStorageInUse
+		}
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,298 @@
+package fshandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// TaggingHeader carries an object's tags, URL query encoded, as in
+// branch=main&env=prod.  It sets the tags on PUT or POST ?tags and reports
+// them on GET and HEAD.
+const TaggingHeader = "X-Coatlocker-Tagging"
+
+// tagDirName holds the tag index inside BaseDirectory.
+const tagDirName = ".tags"
+
+// Limits on tags, per object.
+const (
+	maxTags        = 16
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// SearchResult describes one object found by SearchEndpoint.
+type SearchResult struct {
+	Key         string            `json:"key"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type,omitempty"`
+	ETag        string            `json:"etag,omitempty"`
+	Created     time.Time         `json:"created"`
+	Tags        map[string]string `json:"tags"`
+}
+
+// SearchResponse lists the objects matching a search, sorted by key.
+type SearchResponse struct {
+	Results   []SearchResult `json:"results"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// tagsFromHeader reads the tags sent with r, or nil if there are none.
+func tagsFromHeader(r *http.Request) (map[string]string, error) {
+	encoded := r.Header.Get(TaggingHeader)
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("tags are not query encoded: %s", err)
+	}
+	if len(values) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+
+	tags := make(map[string]string, len(values))
+	for key, value := range values {
+		if len(key) == 0 || len(key) > maxTagKeyLen {
+			return nil, fmt.Errorf("tag keys must be 1 to %d bytes", maxTagKeyLen)
+		}
+		if len(value) != 1 {
+			return nil, fmt.Errorf("tag %s must have exactly one value", key)
+		}
+		if len(value[0]) > maxTagValueLen {
+			return nil, fmt.Errorf("tag values must be at most %d bytes", maxTagValueLen)
+		}
+		tags[key] = value[0]
+	}
+	return tags, nil
+}
+
+// setTagHeaders reports the object's tags on a response.
+func setTagHeaders(w http.ResponseWriter, meta *objectMeta) {
+	if len(meta.Tags) == 0 {
+		return
+	}
+	values := url.Values{}
+	for key, value := range meta.Tags {
+		values.Set(key, value)
+	}
+	w.Header().Set(TaggingHeader, values.Encode())
+}
+
+// setTags handles POST ?tags, replacing the object's tags with those in
+// the tagging header.  Sending none removes them all.
+func (s Server) setTags(w http.ResponseWriter, r *http.Request, key string) {
+	tags, err := tagsFromHeader(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	s.updateMeta(w, r, key, func(meta *objectMeta) int {
+		err := s.indexTags(key, tags)
+		if err != nil {
+			return s.writeErrorStatus(err)
+		}
+		meta.Tags = tags
+		return http.StatusOK
+	})
+}
+
+// The tag index has a directory per tag, named by the hash of key=value,
+// holding an empty file per object with that tag, named by the object's
+// key.  Entries are added before the metadata gains a tag but only removed
+// when the object goes, so the index may list objects that have since lost
+// a tag.  Searches check each object's metadata and drop such entries.
+
+func (s Server) tagDir(key, value string) string {
+	sum := sha256.Sum256([]byte(key + "=" + value))
+	return path.Join(s.BaseDirectory, tagDirName, hex.EncodeToString(sum[:]))
+}
+
+// indexTags adds the object for key to the index of each of tags.
+func (s Server) indexTags(key string, tags map[string]string) error {
+	for tagKey, value := range tags {
+		dir := s.tagDir(tagKey, value)
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path.Join(dir, key), nil, 0666)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropStaleTags removes the object for key from the index of those of
+// tags it no longer carries.  The metadata is read again under the key's
+// lock, since an object being stored is indexed before its metadata is
+// written.
+func (s Server) dropStaleTags(ctx context.Context, key string, tags map[string]string) {
+	unlock := s.lockKey(key)
+	defer unlock()
+	s.unindexStaleTags(ctx, key, tags)
+}
+
+// unindexStaleTags is dropStaleTags for a caller holding the key's lock,
+// such as one that indexed tags for an object it then could not store
+// because the key was taken.  Entries the object there carries stay.
+func (s Server) unindexStaleTags(ctx context.Context, key string, tags map[string]string) {
+	meta, _ := s.readMeta(ctx, s.findPath(key))
+	for tagKey, value := range tags {
+		if meta == nil || meta.Tags[tagKey] != value {
+			os.Remove(path.Join(s.tagDir(tagKey, value), key))
+		}
+	}
+}
+
+// unindexTags removes the object for key from the index of each of tags.
+func (s Server) unindexTags(key string, tags map[string]string) {
+	for tagKey, value := range tags {
+		os.Remove(path.Join(s.tagDir(tagKey, value), key))
+	}
+}
+
+// RebuildTagIndex recreates the tag index from the metadata of every
+// object, for after objects have been moved behind the server's back, as
+// Rekey does.  Searches run meanwhile may miss objects.
+func (s Server) RebuildTagIndex() error {
+	err := os.RemoveAll(path.Join(s.BaseDirectory, tagDirName))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	return s.walkObjects(func(filepath string, info os.FileInfo) error {
+		meta, err := s.readMeta(ctx, filepath)
+		if err != nil || meta == nil {
+			return nil
+		}
+		return s.indexTags(info.Name(), meta.Tags)
+	})
+}
+
+// SearchEndpoint finds the objects carrying every ?tag=key=value given,
+// optionally only those with keys sorting after ?after=.  At most
+// MaxBatchKeys are returned, with the response marked truncated if there
+// are more.  Objects stored with a customer key are only found by requests
+// giving that key, as for a batch stat.
+func (s Server) SearchEndpoint(w http.ResponseWriter, r *http.Request) {
+	customer, err := customerKey(r)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	wanted := map[string]string{}
+	for _, tag := range query["tag"] {
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 {
+			respond.WithStatus(w, r, http.StatusBadRequest)
+			return
+		}
+		wanted[tag[:i]] = tag[i+1:]
+	}
+	if len(wanted) == 0 {
+		respond.WithStatus(w, r, http.StatusBadRequest)
+		return
+	}
+
+	candidates, err := s.taggedKeys(wanted)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	after := query.Get("after")
+	response := SearchResponse{Results: []SearchResult{}}
+	for _, key := range candidates {
+		meta, err := s.readMeta(r.Context(), s.findPath(key))
+		if err != nil {
+			respond.WithStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+		if meta == nil || !hasTags(meta.Tags, wanted) {
+			s.dropStaleTags(r.Context(), key, wanted)
+			continue
+		}
+		if meta.Key <= after || !checkCustomerKey(meta.Encryption, customer) {
+			continue
+		}
+		response.Results = append(response.Results, SearchResult{
+			Key:         meta.Key,
+			Size:        meta.Size,
+			ContentType: meta.ContentType,
+			ETag:        meta.etag(""),
+			Created:     meta.Created,
+			Tags:        meta.Tags,
+		})
+	}
+
+	sort.Slice(response.Results, func(i, j int) bool {
+		return response.Results[i].Key < response.Results[j].Key
+	})
+	if len(response.Results) > MaxBatchKeys {
+		response.Results = response.Results[:MaxBatchKeys]
+		response.Truncated = true
+	}
+	respond.With(w, r, http.StatusOK, response)
+}
+
+// taggedKeys returns the keys the index lists under every one of tags.
+func (s Server) taggedKeys(tags map[string]string) ([]string, error) {
+	var keys []string
+	first := true
+	for tagKey, value := range tags {
+		infos, err := ioutil.ReadDir(s.tagDir(tagKey, value))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		listed := make(map[string]bool, len(infos))
+		for _, info := range infos {
+			listed[info.Name()] = true
+		}
+		if first {
+			for name := range listed {
+				keys = append(keys, name)
+			}
+			first = false
+			continue
+		}
+
+		kept := keys[:0]
+		for _, key := range keys {
+			if listed[key] {
+				kept = append(kept, key)
+			}
+		}
+		keys = kept
+	}
+	return keys, nil
+}
+
+func hasTags(tags, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
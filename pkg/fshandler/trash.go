@@ -0,0 +1,236 @@
+package fshandler
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// trashDirName holds soft deleted objects inside BaseDirectory.
+const trashDirName = ".trash"
+
+// DefaultPurgeInterval is how often expired trash is removed.
+const DefaultPurgeInterval = time.Hour
+
+// TrashEntry describes a soft deleted object.
+type TrashEntry struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key,omitempty"`
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"`
+}
+
+// TrashEndpoint lists soft deleted objects for admins, optionally limited
+// to keys starting with ?prefix=.
+func (s Server) TrashEndpoint(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+
+	entries, err := s.trashEntries(r.Context())
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	listed := []TrashEntry{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Key, prefix) {
+			listed = append(listed, entry)
+		}
+	}
+	respond.With(w, r, http.StatusOK, listed)
+}
+
+func (s Server) trashDir() string {
+	return path.Join(s.BaseDirectory, trashDirName)
+}
+
+// trashName names the trash entry for key deleted at when.
+func trashName(key string, when time.Time) string {
+	return key + "." + strconv.FormatInt(when.UnixNano(), 10)
+}
+
+// parseTrashName splits a trash entry name into its key and deletion time.
+func parseTrashName(name string) (string, time.Time, bool) {
+	i := strings.IndexByte(name, '.')
+	if i < 0 || !isKeyName(name[:i]) {
+		return "", time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[:i], time.Unix(0, nanos).UTC(), true
+}
+
+// trashObject moves the object at filepath into the trash.  The data keeps
+// its inode, so a deduplicated blob stays referenced until it is purged.
+func (s Server) trashObject(ctx context.Context, key, filepath string) error {
+	defer s.timed(ctx, "trash")()
+
+	err := os.MkdirAll(s.trashDir(), 0777)
+	if err != nil {
+		return err
+	}
+
+	entry := path.Join(s.trashDir(), trashName(key, time.Now()))
+	err = os.Rename(filepath, entry)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(metaPath(filepath), metaPath(entry))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Anything left at the other layout's path goes too.
+	return s.removeObject(ctx, key)
+}
+
+// trashEntries lists the trash, newest first.
+func (s Server) trashEntries(ctx context.Context) ([]TrashEntry, error) {
+	infos, err := ioutil.ReadDir(s.trashDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []TrashEntry
+	for _, info := range infos {
+		key, deleted, ok := parseTrashName(info.Name())
+		if !ok {
+			continue
+		}
+
+		entry := TrashEntry{
+			ID:      strconv.FormatInt(deleted.UnixNano(), 10),
+			Hash:    key,
+			Size:    info.Size(),
+			Deleted: deleted,
+			Expires: deleted.Add(s.TrashRetention),
+		}
+		meta, err := s.readMeta(ctx, path.Join(s.trashDir(), info.Name()))
+		if err == nil && meta != nil {
+			entry.Key = meta.Key
+			entry.Size = meta.Size
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// undelete restores the object for key from the trash.  With an empty id
+// the most recently deleted copy comes back.
+func (s Server) undelete(w http.ResponseWriter, r *http.Request, key, id string) {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	filepath := s.genPath(key)
+	if checkFile(s.findPath(key)) == nil {
+		respond.WithStatus(w, r, http.StatusConflict)
+		return
+	}
+
+	entries, err := s.trashEntries(r.Context())
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var entry string
+	for _, candidate := range entries {
+		if candidate.Hash == key && (len(id) == 0 || candidate.ID == id) {
+			entry = path.Join(s.trashDir(), key+"."+candidate.ID)
+			break
+		}
+	}
+	if len(entry) == 0 {
+		respond.WithStatus(w, r, http.StatusNotFound)
+		return
+	}
+
+	meta, err := s.readMeta(r.Context(), entry)
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+	if meta != nil {
+		err = s.indexTags(key, meta.Tags)
+		if err != nil {
+			s.respondWriteError(w, r, err)
+			return
+		}
+	}
+
+	err = s.placeObject(r.Context(), filepath, meta, func() error {
+		return os.Rename(entry, filepath)
+	})
+	if err != nil {
+		if meta != nil {
+			s.unindexTags(key, meta.Tags)
+		}
+		s.respondWriteError(w, r, err)
+		return
+	}
+	os.Remove(metaPath(entry))
+	s.publish(EventCreated, key, meta)
+	respond.WithStatus(w, r, http.StatusOK)
+}
+
+// PurgeTrash permanently removes trash entries older than TrashRetention.
+func (s Server) PurgeTrash() (int, error) {
+	entries, err := s.trashEntries(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, entry := range entries {
+		if entry.Expires.After(now) {
+			continue
+		}
+		name := path.Join(s.trashDir(), entry.Hash+"."+entry.ID)
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+		os.Remove(metaPath(name))
+		s.publish(EventExpired, entry.Hash, &objectMeta{Key: entry.Key, Size: entry.Size})
+		purged++
+	}
+	return purged, nil
+}
+
+func (s Server) purgeTrashEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		purged, err := s.PurgeTrash()
+		if err != nil {
+			log.Printf("Trash purge failed: %s", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Trash purge removed %d objects", purged)
+		}
+	}
+}
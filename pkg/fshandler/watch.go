@@ -0,0 +1,196 @@
+package fshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// MaxWait is the longest GET ?wait= will hold a request open.
+const MaxWait = 5 * time.Minute
+
+// watchBuffer is how many events a watcher may fall behind by before it is
+// dropped.
+const watchBuffer = 64
+
+// keepaliveInterval is how often an idle watch stream sends a comment, so
+// proxies do not time it out.
+const keepaliveInterval = 15 * time.Second
+
+// waitPollInterval is how often a waiting GET looks for its object in case
+// it arrived without an event, as after a restore behind the server's back.
+const waitPollInterval = time.Second
+
+// Watchers hands object change events to the clients watching for them in
+// this process.  Unlike webhooks nothing is kept: a watcher only sees what
+// happens while it is connected.
+type Watchers struct {
+	mu       sync.Mutex
+	watchers map[chan Event]func(Event) bool
+}
+
+// NewWatchers returns an empty set of watchers.
+func NewWatchers() *Watchers {
+	return &Watchers{watchers: map[chan Event]func(Event) bool{}}
+}
+
+// Watch returns a channel receiving the events match accepts, and a
+// function to stop watching.  A watcher too slow to keep up has its
+// channel closed rather than holding up the requests making changes.
+func (w *Watchers) Watch(match func(Event) bool) (<-chan Event, func()) {
+	if w == nil {
+		return nil, func() {}
+	}
+
+	events := make(chan Event, watchBuffer)
+	w.mu.Lock()
+	w.watchers[events] = match
+	w.mu.Unlock()
+
+	return events, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.watchers[events]; ok {
+			delete(w.watchers, events)
+			close(events)
+		}
+	}
+}
+
+// Broadcast hands event to every watcher wanting it.
+func (w *Watchers) Broadcast(event Event) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for events, match := range w.watchers {
+		if !match(event) {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			delete(w.watchers, events)
+			close(events)
+		}
+	}
+}
+
+// WatchEndpoint streams the create and delete events for objects with keys
+// starting with ?prefix= as Server-Sent Events, one per change, until the
+// client goes away or the server shuts down.  Each event is named for its
+// type and carries the Event as JSON.  Objects stored before keys were
+// recorded are only seen by watchers of every key.
+func (s Server) WatchEndpoint(w http.ResponseWriter, r *http.Request) {
+	if s.Watchers == nil {
+		respond.WithStatus(w, r, http.StatusNotImplemented)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if s.FoldCase {
+		prefix = strings.ToLower(prefix)
+	}
+	events, stop := s.Watchers.Watch(func(event Event) bool {
+		return len(prefix) == 0 || strings.HasPrefix(event.Key, prefix)
+	})
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.Drain.Done():
+			return
+		case <-keepalive.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// waitDuration reads GET ?wait=, which must be a duration such as 30s.  It
+// is capped at MaxWait.
+func waitDuration(r *http.Request) (time.Duration, error) {
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		return 0, err
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("wait must not be negative")
+	}
+	if wait > MaxWait {
+		wait = MaxWait
+	}
+	return wait, nil
+}
+
+// waitFor blocks until the object for key exists, wait has passed, the
+// client goes away or the server shuts down, and reports whether the
+// object turned up.
+func (s Server) waitFor(r *http.Request, key string, wait time.Duration) bool {
+	events, stop := s.Watchers.Watch(func(event Event) bool {
+		return event.Hash == key && event.Type == EventCreated
+	})
+	defer stop()
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	poll := time.NewTicker(waitPollInterval)
+	defer poll.Stop()
+	for {
+		// Checking after watching starts means a create in between is
+		// never missed.
+		if checkFile(s.findPath(key)) == nil {
+			return true
+		}
+
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-s.Drain.Done():
+			return checkFile(s.findPath(key)) == nil
+		case <-timeout.C:
+			return checkFile(s.findPath(key)) == nil
+		case <-poll.C:
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		}
+	}
+}
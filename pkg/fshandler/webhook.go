@@ -0,0 +1,409 @@
+package fshandler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	respond "gopkg.in/matryer/respond.v1"
+)
+
+// Event types sent to webhooks.
+const (
+	EventCreated = "object.created"
+	EventDeleted = "object.deleted"
+	EventExpired = "object.expired"
+)
+
+// Headers sent with every webhook delivery.  The signature is the hex
+// HMAC-SHA256 of the body under the shared secret, prefixed with sha256=.
+const (
+	EventHeader     = "X-Coatlocker-Event"
+	DeliveryHeader  = "X-Coatlocker-Delivery"
+	SignatureHeader = "X-Coatlocker-Signature"
+)
+
+// Delivery tuning.  A failed delivery is retried after RetryBackoff,
+// doubling each time up to MaxRetryBackoff, and moves to the dead letters
+// after MaxDeliveryAttempts.
+const (
+	RetryBackoff        = time.Second
+	MaxRetryBackoff     = time.Hour
+	MaxDeliveryAttempts = 12
+)
+
+// outboxDirName holds undelivered events inside BaseDirectory, and
+// deadDirName the ones given up on inside that.
+const (
+	outboxDirName = ".outbox"
+	deadDirName   = "dead"
+)
+
+// outboxPollInterval is how often the outbox is checked for retries that
+// have come due.
+const outboxPollInterval = time.Second
+
+// Event describes a change to an object.  Key is empty for objects stored
+// before keys were recorded; Hash always identifies the object.
+type Event struct {
+	Type string    `json:"type"`
+	Key  string    `json:"key,omitempty"`
+	Hash string    `json:"hash"`
+	Size int64     `json:"size,omitempty"`
+	ETag string    `json:"etag,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// Delivery is one event on its way to one webhook, as kept in the outbox.
+type Delivery struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Notifier sends events to webhooks.  Events are written to an outbox on
+// disk before anything is sent, so they survive a restart, and each is
+// retried until it is delivered or runs out of attempts.
+type Notifier struct {
+	URLs   []string
+	Secret []byte
+	Dir    string
+	Client *http.Client
+
+	mu   sync.RWMutex
+	wake chan struct{}
+
+	// sending holds the URLs being delivered to.
+	sendingMu sync.Mutex
+	sending   map[string]bool
+}
+
+// NewNotifier returns a notifier keeping its outbox in baseDirectory.
+func NewNotifier(baseDirectory string, urls []string, secret string) *Notifier {
+	return &Notifier{
+		URLs:   urls,
+		Secret: []byte(secret),
+		Dir:    path.Join(baseDirectory, outboxDirName),
+		Client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Validate checks the webhook URLs and that there is a secret to sign with.
+func (n *Notifier) Validate() error {
+	if n == nil {
+		return nil
+	}
+	urls, secret := n.targets()
+	if len(secret) == 0 {
+		return fmt.Errorf("webhooks need a secret to sign with")
+	}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("webhook %q is not an http or https URL", raw)
+		}
+	}
+	return nil
+}
+
+// Start delivers the outbox in the background.
+func (n *Notifier) Start() error {
+	if n == nil {
+		return nil
+	}
+	err := os.MkdirAll(path.Join(n.Dir, deadDirName), 0777)
+	if err != nil {
+		return err
+	}
+	go n.run()
+	return nil
+}
+
+// SetTargets replaces the webhook URLs and the secret payloads are signed
+// with.  Deliveries already queued still go to the URL they were queued
+// for.
+func (n *Notifier) SetTargets(urls []string, secret string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.URLs = urls
+	n.Secret = []byte(secret)
+}
+
+func (n *Notifier) targets() ([]string, []byte) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.URLs, n.Secret
+}
+
+// Publish queues event for every webhook.
+func (n *Notifier) Publish(event Event) error {
+	if n == nil {
+		return nil
+	}
+	urls, _ := n.targets()
+	for _, u := range urls {
+		id, err := deliveryID(event.Time)
+		if err != nil {
+			return err
+		}
+		err = n.save(n.Dir, &Delivery{ID: id, URL: u, Event: event, NextAttempt: event.Time})
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// DeadLetters lists the deliveries that were given up on, oldest first.
+func (n *Notifier) DeadLetters() ([]Delivery, error) {
+	if n == nil {
+		return nil, nil
+	}
+	return n.load(path.Join(n.Dir, deadDirName))
+}
+
+// deliveryID makes an ID that sorts by time, so the outbox is worked
+// through in the order events happened.
+func deliveryID(when time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	_, err := io.ReadFull(rand.Reader, suffix)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d-%s", when.UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+func (n *Notifier) save(dir string, delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return writeDurable(path.Join(dir, delivery.ID+".json"), data)
+}
+
+// load reads every delivery in dir, in ID order.
+func (n *Notifier) load(dir string) ([]Delivery, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []Delivery
+	for _, info := range infos {
+		if info.IsDir() || path.Ext(info.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, info.Name()))
+		if err != nil {
+			continue
+		}
+		var delivery Delivery
+		if json.Unmarshal(data, &delivery) == nil {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	return deliveries, nil
+}
+
+func (n *Notifier) run() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		n.flush()
+		select {
+		case <-n.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// flush attempts every delivery that is due.  Each URL is sent to on its
+// own, so one that is down or slow does not hold up the others, and is left
+// out of passes until its last one is done.
+func (n *Notifier) flush() {
+	// Held across loading, so nothing read is from before a send finished.
+	n.sendingMu.Lock()
+	defer n.sendingMu.Unlock()
+	if n.sending == nil {
+		n.sending = map[string]bool{}
+	}
+
+	deliveries, err := n.load(n.Dir)
+	if err != nil {
+		log.Printf("Unable to read the webhook outbox: %s", err)
+		return
+	}
+
+	now := time.Now()
+	due := map[string][]*Delivery{}
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		if delivery.NextAttempt.After(now) {
+			continue
+		}
+		due[delivery.URL] = append(due[delivery.URL], delivery)
+	}
+
+	for u, queue := range due {
+		if n.sending[u] {
+			continue
+		}
+		n.sending[u] = true
+		go func(u string, queue []*Delivery) {
+			n.flushURL(queue)
+			n.sendingMu.Lock()
+			delete(n.sending, u)
+			n.sendingMu.Unlock()
+		}(u, queue)
+	}
+}
+
+// flushURL attempts the due deliveries for one URL in order.  Once one
+// fails the rest wait for the next pass rather than each timing out
+// against a URL that is down, and are not counted as attempted.
+func (n *Notifier) flushURL(queue []*Delivery) {
+	for _, delivery := range queue {
+		name := path.Join(n.Dir, delivery.ID+".json")
+		err := n.send(delivery)
+		if err == nil {
+			os.Remove(name)
+			continue
+		}
+
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= MaxDeliveryAttempts {
+			log.Printf("Giving up on webhook delivery %s to %s: %s", delivery.ID, delivery.URL, err)
+			err = os.Rename(name, path.Join(n.Dir, deadDirName, delivery.ID+".json"))
+			if err == nil {
+				err = n.save(path.Join(n.Dir, deadDirName), delivery)
+			}
+		} else {
+			delivery.NextAttempt = time.Now().Add(retryBackoff(delivery.Attempts))
+			err = n.save(n.Dir, delivery)
+		}
+		if err != nil {
+			log.Printf("Unable to update webhook delivery %s: %s", delivery.ID, err)
+		}
+		return
+	}
+}
+
+// retryBackoff is how long to wait after the given number of failures.
+func retryBackoff(attempts int) time.Duration {
+	backoff := RetryBackoff
+	for i := 1; i < attempts && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRetryBackoff {
+		backoff = MaxRetryBackoff
+	}
+	return backoff
+}
+
+// send posts a delivery, succeeding on any 2xx response.
+func (n *Notifier) send(delivery *Delivery) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, "sha256="+n.sign(body))
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) sign(body []byte) string {
+	_, secret := n.targets()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// publish tells watchers and queues for webhooks an event of type kind
+// about the object for key.  A lost event is logged rather than failing
+// the request, which has already changed the object.
+func (s Server) publish(kind, key string, meta *objectMeta) {
+	if s.Events == nil && s.Watchers == nil {
+		return
+	}
+
+	event := Event{Type: kind, Hash: key, Time: time.Now().UTC()}
+	if meta != nil {
+		event.Key = meta.Key
+		event.Size = meta.Size
+		event.ETag = meta.etag("")
+	}
+	s.Watchers.Broadcast(event)
+	err := s.Events.Publish(event)
+	if err != nil {
+		log.Printf("Unable to queue %s event for %s: %s", kind, key, err)
+	}
+}
+
+// WebhookEndpoint lists webhook deliveries that were given up on, for
+// admins.
+func (s Server) WebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		respond.WithStatus(w, r, http.StatusForbidden)
+		return
+	}
+
+	dead, err := s.Events.DeadLetters()
+	if err != nil {
+		respond.WithStatus(w, r, http.StatusInternalServerError)
+		return
+	}
+	if dead == nil {
+		dead = []Delivery{}
+	}
+	respond.With(w, r, http.StatusOK, dead)
+}
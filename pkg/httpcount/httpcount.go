@@ -0,0 +1,143 @@
+// Package httpcount wraps request bodies and response writers to count
+// what passes through them, for the middleware that logs, measures and
+// traces requests.  The outermost of those middleware wraps them once and
+// the rest find the wrapping in the request's context.
+package httpcount
+
+import (
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Body counts, and optionally hashes, a request body as the handler reads
+// it.  Reading may carry on after a timeout has answered the request, so
+// it is locked.
+type Body struct {
+	io.ReadCloser
+
+	mu     sync.Mutex
+	hasher hash.Hash
+	read   int64
+}
+
+// hashWith starts hashing what is read with hasher, unless the body is
+// already hashed.  It must come before the handler reads anything.
+func (b *Body) hashWith(hasher hash.Hash) {
+	b.mu.Lock()
+	if b.hasher == nil {
+		b.hasher = hasher
+	}
+	b.mu.Unlock()
+}
+
+// NewBody wraps body, hashing what is read with hasher unless it is nil.
+func NewBody(body io.ReadCloser, hasher hash.Hash) *Body {
+	return &Body{ReadCloser: body, hasher: hasher}
+}
+
+func (b *Body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if b.hasher != nil {
+		b.hasher.Write(p[:n])
+	}
+	b.read += int64(n)
+	b.mu.Unlock()
+	return n, err
+}
+
+// Count is the number of bytes read so far.
+func (b *Body) Count() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.read
+}
+
+// Sum is the number of bytes read so far and the hex digest of them, which
+// is empty without a hasher.
+func (b *Body) Sum() (int64, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.hasher == nil {
+		return b.read, ""
+	}
+	return b.read, hex.EncodeToString(b.hasher.Sum(nil))
+}
+
+// ResponseWriter notes the status and counts the bytes of the response.
+type ResponseWriter struct {
+	http.ResponseWriter
+
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+// NewResponseWriter wraps w, with the status taken to be 200 until the
+// handler says otherwise.
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *ResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush passes flushes on, for the streaming endpoints.
+func (w *ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Status is the status the handler answered with.
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
+// Written is the number of bytes of the response body written.
+func (w *ResponseWriter) Written() int64 {
+	return w.written
+}
+
+type countedKey struct{}
+
+// counted is a request's body and response writer as wrapped by Wrap.
+type counted struct {
+	body   *Body
+	writer *ResponseWriter
+}
+
+// Wrap counts the body of r and the response written to w, hashing the
+// body with hasher unless it is nil.  The first middleware to call it
+// wraps them and hands the wrapped request and writer on; those further in
+// are handed back w and r unchanged with the same Body and ResponseWriter,
+// which then count the response as it leaves the outermost middleware.
+func Wrap(w http.ResponseWriter, r *http.Request, hasher hash.Hash) (http.ResponseWriter, *http.Request, *Body, *ResponseWriter) {
+	if c, ok := r.Context().Value(countedKey{}).(*counted); ok {
+		if hasher != nil {
+			c.body.hashWith(hasher)
+		}
+		return w, r, c.body, c.writer
+	}
+
+	c := &counted{body: NewBody(r.Body, hasher), writer: NewResponseWriter(w)}
+	r = r.WithContext(context.WithValue(r.Context(), countedKey{}, c))
+	r.Body = c.body
+	return c.writer, r, c.body, c.writer
+}
@@ -0,0 +1,50 @@
+package identity
+
+import (
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/drhayt/coatlocker/pkg/trace"
+)
+
+// UserProperty is the request context key the JWT middleware stores the
+// validated token under.
+const UserProperty = "user"
+
+// Subject returns the subject of the request's validated JWT, or an empty
+// string if the request carries none.
+func Subject(r *http.Request) string {
+	token, ok := r.Context().Value(UserProperty).(*jwt.Token)
+	if !ok || token == nil {
+		return ""
+	}
+
+	switch claims := token.Claims.(type) {
+	case jwt.MapClaims:
+		subject, _ := claims["sub"].(string)
+		return subject
+	case *jwt.StandardClaims:
+		return claims.Subject
+	}
+	return ""
+}
+
+// IsAdmin reports whether the request's subject is one of admins.
+func IsAdmin(r *http.Request, admins []string) bool {
+	_, span := trace.Start(r.Context(), "authorize.admin")
+	defer span.End()
+
+	subject := Subject(r)
+	if len(subject) == 0 {
+		span.SetAttribute("allowed", false)
+		return false
+	}
+	for _, admin := range admins {
+		if admin == subject {
+			span.SetAttribute("allowed", true)
+			return true
+		}
+	}
+	span.SetAttribute("allowed", false)
+	return false
+}
@@ -0,0 +1,281 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text format.  Every metric is a vector over its labels,
+// with label values given in order on each update.  A nil registry, and
+// the nil metrics it hands out, quietly do nothing.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram bounds, in seconds, used for request
+// and operation latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 90}
+
+// Metric kinds, as named in the exposition format.
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// Registry holds metrics by name.
+type Registry struct {
+	mu      sync.Mutex
+	vectors map[string]*vector
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{vectors: map[string]*vector{}}
+}
+
+type vector struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// register returns the metric called name, creating it if need be, so
+// callers may ask for a metric wherever they use it.
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *vector {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.vectors[name]; ok {
+		if v.kind != kind {
+			panic(fmt.Sprintf("metric %s is a %s, not a %s", name, v.kind, kind))
+		}
+		return v
+	}
+	v := &vector{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.vectors[name] = v
+	return v
+}
+
+// with returns the series for the given label values, creating it if need
+// be.  The caller holds v.mu.
+func (v *vector) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, not %d", v.name, len(v.labels), len(values)))
+	}
+	id := strings.Join(values, "\xff")
+	s, ok := v.series[id]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if v.kind == kindHistogram {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[id] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up.
+type Counter vector
+
+// Counter returns the counter called name.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return (*Counter)(r.register(name, help, kindCounter, nil, labels))
+}
+
+// Add adds delta, which must not be negative, to the series for values.
+func (c *Counter) Add(delta float64, values ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	(*vector)(c).with(values).value += delta
+	c.mu.Unlock()
+}
+
+// Inc adds one to the series for values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge vector
+
+// Gauge returns the gauge called name.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return (*Gauge)(r.register(name, help, kindGauge, nil, labels))
+}
+
+// GaugeFunc registers a gauge without labels whose value is read from fn
+// whenever the metrics are served.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	v := r.register(name, help, kindGauge, nil, nil)
+	if v != nil {
+		v.mu.Lock()
+		v.fn = fn
+		v.mu.Unlock()
+	}
+}
+
+// Add adds delta, which may be negative, to the series for values.
+func (g *Gauge) Add(delta float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	(*vector)(g).with(values).value += delta
+	g.mu.Unlock()
+}
+
+// Set sets the series for values.
+func (g *Gauge) Set(value float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	(*vector)(g).with(values).value = value
+	g.mu.Unlock()
+}
+
+// Histogram counts observations into buckets.
+type Histogram vector
+
+// Histogram returns the histogram called name, counting observations
+// into buckets, which must be sorted.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return (*Histogram)(r.register(name, help, kindHistogram, buckets, labels))
+}
+
+// Observe records value in the series for values.
+func (h *Histogram) Observe(value float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := (*vector)(h).with(values)
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.value += value
+	s.count++
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r == nil {
+		http.NotFound(w, req)
+		return
+	}
+	r.mu.Lock()
+	vectors := make([]*vector, 0, len(r.vectors))
+	for _, v := range r.vectors {
+		vectors = append(vectors, v)
+	}
+	r.mu.Unlock()
+	sort.Slice(vectors, func(i, j int) bool {
+		return vectors[i].name < vectors[j].name
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	for _, v := range vectors {
+		v.write(out)
+	}
+	out.Flush()
+}
+
+func (v *vector) write(out *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s %s\n", v.name, strings.Replace(v.help, "\n", " ", -1))
+	fmt.Fprintf(out, "# TYPE %s %s\n", v.name, v.kind)
+	if v.fn != nil {
+		fmt.Fprintf(out, "%s %s\n", v.name, formatValue(v.fn()))
+		return
+	}
+
+	all := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].values, "\xff") < strings.Join(all[j].values, "\xff")
+	})
+
+	for _, s := range all {
+		if v.kind != kindHistogram {
+			fmt.Fprintf(out, "%s%s %s\n", v.name, v.labelSet(s.values, "", ""), formatValue(s.value))
+			continue
+		}
+		cumulative := uint64(0)
+		for i, bound := range v.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(out, "%s_bucket%s %d\n", v.name, v.labelSet(s.values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", v.name, v.labelSet(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", v.name, v.labelSet(s.values, "", ""), formatValue(s.value))
+		fmt.Fprintf(out, "%s_count%s %d\n", v.name, v.labelSet(s.values, "", ""), s.count)
+	}
+}
+
+// labelSet formats the labels for values, plus extra=value if extra is
+// set, as {a="1",b="2"}.
+func (v *vector) labelSet(values []string, extra, value string) string {
+	var pairs []string
+	for i, label := range v.labels {
+		pairs = append(pairs, label+"="+quote(values[i]))
+	}
+	if len(extra) != 0 {
+		pairs = append(pairs, extra+"="+quote(value))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,309 @@
+// Package trace records spans of work and exports them, continuing traces
+// begun by callers through the W3C traceparent header.  A request with no
+// span in its context is not traced, and the nil spans handed out for it
+// quietly do nothing.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader carries the trace a request belongs to.
+const TraceParentHeader = "traceparent"
+
+// Span kinds, numbered as OTLP numbers them.
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+// Export tuning.  Spans are sent in batches of up to maxBatch, at least
+// every exportInterval, and dropped if more than queueSize are waiting.
+const (
+	maxBatch       = 512
+	exportInterval = 5 * time.Second
+	queueSize      = 4096
+)
+
+// SpanData is a finished span as handed to an exporter.  IDs are hex.
+type SpanData struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         int                    `json:"kind"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// Tracer starts traces for requests and exports their spans in the
+// background.
+type Tracer struct {
+	exporter Exporter
+	queue    chan SpanData
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewTracer returns a tracer sending spans to exporter.
+func NewTracer(exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		queue:    make(chan SpanData, queueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Close exports the spans still waiting.  Spans ended afterwards are lost.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	<-t.done
+	return nil
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < maxBatch {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+func (t *Tracer) export(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	err := t.exporter.Export(batch)
+	if err != nil {
+		log.Printf("Unable to export %d spans: %s", len(batch), err)
+	}
+}
+
+type spanKey struct{}
+
+// Span is a timed piece of work within a trace.
+type Span struct {
+	tracer  *Tracer
+	traceID string
+	spanID  string
+	sampled bool
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// StartRequest starts the server span for r, continuing the trace in its
+// traceparent header if there is a valid one.  Traces the caller chose not
+// to sample are followed but not exported.
+func (t *Tracer) StartRequest(r *http.Request) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+
+	traceID, parentID, sampled, ok := parseTraceParent(r.Header.Get(TraceParentHeader))
+	if !ok {
+		var err error
+		traceID, err = newID(16)
+		if err != nil {
+			log.Printf("Unable to start a trace: %s", err)
+			return r.Context(), nil
+		}
+		parentID, sampled = "", true
+	}
+	span := t.newSpan(traceID, parentID, sampled, r.Method, KindServer)
+	if span == nil {
+		return r.Context(), nil
+	}
+	return context.WithValue(r.Context(), spanKey{}, span), span
+}
+
+// Start starts a span called name as a child of the span in ctx, if there
+// is one.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(parent.traceID, parent.spanID, parent.sampled, name, KindInternal)
+	if span == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// newSpan starts a span, or returns nil, leaving the work untraced, if it
+// can not be given an ID.
+func (t *Tracer) newSpan(traceID, parentID string, sampled bool, name string, kind int) *Span {
+	spanID, err := newID(8)
+	if err != nil {
+		log.Printf("Unable to start span %s: %s", name, err)
+		return nil
+	}
+	span := &Span{
+		tracer:  t,
+		traceID: traceID,
+		spanID:  spanID,
+		sampled: sampled,
+	}
+	span.data = SpanData{
+		TraceID:      traceID,
+		SpanID:       span.spanID,
+		ParentSpanID: parentID,
+		Name:         name,
+		Kind:         kind,
+		Start:        time.Now(),
+	}
+	return span
+}
+
+// SetAttribute records a string, integer or boolean value on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = map[string]interface{}{}
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Error = message
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export.  Only the first call
+// counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if !s.sampled {
+		return
+	}
+	select {
+	case s.tracer.queue <- data:
+	default:
+	}
+}
+
+// TraceParent formats the span as a traceparent header value, for passing
+// the trace on.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.traceID, s.spanID, flags)
+}
+
+// parseTraceParent reads a version 00 traceparent header, or a later
+// version's leading fields as the specification asks.
+func parseTraceParent(header string) (traceID, parentID string, sampled, ok bool) {
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || (fields[0] == "00" && len(fields) != 4) || fields[0] == "ff" {
+		return "", "", false, false
+	}
+	if !isHex(fields[0], 2) || !isHex(fields[1], 32) || !isHex(fields[2], 16) || !isHex(fields[3], 2) {
+		return "", "", false, false
+	}
+	if strings.Trim(fields[1], "0") == "" || strings.Trim(fields[2], "0") == "" {
+		return "", "", false, false
+	}
+	flags, _ := hex.DecodeString(fields[3])
+	return fields[1], fields[2], flags[0]&1 == 1, true
+}
+
+// isHex reports whether s is n lower case hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newID makes a random hex ID of size bytes.
+func newID(size int) (string, error) {
+	id := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}